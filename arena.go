@@ -0,0 +1,76 @@
+package lsm
+
+import "unsafe"
+
+// Arena
+//
+// A memtable allocates several objects per write: the key and value
+// bytes, a skiplist node, and its links. Allocated one by one, a full
+// 4 MB memtable is hundreds of thousands of small heap objects for
+// the garbage collector to trace. An arena instead carves them out of
+// large chunks, one chunk type per kind of object, so the collector
+// sees a few hundred chunks, and the whole memtable is freed at once
+// when the last reference to it goes.
+//
+// The arena also counts the memory it allocates, whole chunks
+// included, which is what the memtable reports as its size. Chunks
+// start small and double up to arenaChunkSize, so a small memtable
+// isn't charged for large chunks it never fills.
+//
+// Memory is never reused: an older version of a key stays allocated
+// until the memtable is dropped. Chunks are reachable through the
+// slices carved from them, so nothing must be freed explicitly.
+
+// Chunk sizes for each kind of object grow from arenaMinChunkSize
+// to arenaChunkSize.
+const (
+	arenaMinChunkSize = 64
+	arenaChunkSize    = 64 * 1024
+)
+
+// arena allocates the memory of one skiplist. It is used by the
+// skiplist's single writer only.
+type arena struct {
+	bytes []byte
+	nodes []skipNode
+	links []skipLink
+	used  int64
+}
+
+// arenaCopy returns a copy of s in arena memory, non-nil even when
+// empty. The result's capacity is capped, so appending to it cannot
+// clobber a neighbor.
+func arenaCopy[S string | []byte](a *arena, s S) []byte {
+	if len(s) == 0 {
+		return []byte{}
+	}
+	b := carve(a, &a.bytes, len(s))
+	copy(b, s)
+	return b
+}
+
+func (a *arena) newNode() *skipNode { return &carve(a, &a.nodes, 1)[0] }
+
+func (a *arena) newLinks(height int) []skipLink {
+	return carve(a, &a.links, height)
+}
+
+// carve returns n zeroed elements from the current chunk in pool,
+// starting a new chunk, twice the size of the last, when it runs
+// out. Requests too large for a chunk get their own allocation.
+func carve[T any](a *arena, pool *[]T, n int) []T {
+	var zero T
+	size := int(unsafe.Sizeof(zero))
+	if n > arenaChunkSize/size/4 {
+		a.used += int64(n * size)
+		return make([]T, n)
+	}
+	if cap(*pool)-len(*pool) < n {
+		chunk := min(max(2*cap(*pool), arenaMinChunkSize/size, n), arenaChunkSize/size)
+		a.used += int64(chunk * size)
+		*pool = make([]T, 0, chunk)
+	}
+	p := *pool
+	*pool = p[:len(p)+n]
+	return p[len(p) : len(p)+n : len(p)+n]
+}
@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// WriteBatch collects Put, PutWithTTL, Delete, and DeleteRange
+// operations to be applied atomically by DB.Write. The whole batch is
+// logged as a single WAL record, so after a crash either every
+// operation is recovered or none is. The zero value is an empty batch
+// ready to use.
+type WriteBatch struct {
+	entries []WALEntry
+	err     error // first invalid operation, reported by DB.Write
+}
+
+// Put adds a key-value write to the batch. The key and value are
+// copied, so the caller may reuse them after Put returns.
+func (b *WriteBatch) Put(key string, value []byte) {
+	val := make([]byte, len(value))
+	copy(val, value)
+	b.entries = append(b.entries, WALEntry{Op: OpPut, Key: []byte(key), Value: val})
+}
+
+// PutWithTTL adds a write of key that expires ttl after the batch is
+// written, as told by Options.Clock. A ttl that isn't positive makes
+// DB.Write fail.
+func (b *WriteBatch) PutWithTTL(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		if b.err == nil {
+			b.err = fmt.Errorf("ttl must be positive, got %v", ttl)
+		}
+		return
+	}
+	b.Put(key, value)
+	b.entries[len(b.entries)-1].ttl = ttl
+}
+
+// Delete adds a tombstone for key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, WALEntry{Op: OpDelete, Key: []byte(key)})
+}
+
+// DeleteRange adds a range tombstone for the keys in [start, end)
+// to the batch. An empty range is ignored.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	if start >= end {
+		return
+	}
+	b.entries = append(b.entries, WALEntry{Op: OpDeleteRange, Key: []byte(start), Value: []byte(end)})
+}
+
+// Clear removes all operations so the batch can be reused.
+func (b *WriteBatch) Clear() {
+	b.entries = b.entries[:0]
+	b.err = nil
+}
+
+// Count returns the number of operations in the batch.
+func (b *WriteBatch) Count() int {
+	return len(b.entries)
+}
@@ -0,0 +1,274 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Blocks
+//
+// A v2 SSTable stores its entries in data blocks of about
+// Options.BlockSize bytes. Within a block each key is stored as the
+// length of the prefix it shares with the previous key plus the
+// remaining suffix. Every blockRestartInterval entries a restart
+// point stores a full key instead, and the block ends with the
+// offsets of its restart points so a lookup can binary-search them
+// and decode only a short run of entries.
+//
+//	Entry:   [shared uvarint][unshared uvarint][value_len uvarint][kind(1)][seq uvarint][key suffix][value]
+//	Trailer: [restart offset(4)]...[restart count(4)]
+//
+// The value of a kindExpiringValue entry starts with its expiry
+// (see ttl.go) as 8 little-endian bytes of Unix nanoseconds.
+//
+// Entries are in internal order (see snapshot.go): by key, then
+// newest sequence number first. Blocks of tables before v5 have no
+// seq field, and their entries read as sequence number 0.
+//
+// The index block uses the same layout, with one entry per data
+// block whose key and sequence number are those of the last entry in
+// that block.
+
+// blockRestartInterval is the number of entries between restart
+// points.
+const blockRestartInterval = 16
+
+// Entry kinds.
+const (
+	kindValue       byte = 0
+	kindTombstone   byte = 1
+	kindRangeDelete byte = 2 // only in the range tombstone block
+
+	kindExpiringValue byte = 3
+	kindMerge         byte = 4 // a merge operand (see merge.go)
+)
+
+// errCorruptBlock is returned for a block that does not decode.
+var errCorruptBlock = fmt.Errorf("%w: sstable block does not decode", ErrCorruption)
+
+// blockBuilder accumulates sorted entries into a block.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	counter  int // entries since the last restart point
+	lastKey  []byte
+	lastSeq  uint64
+	entries  int
+}
+
+// add appends an entry. Entries must be added in internal order.
+func (b *blockBuilder) add(key string, seq uint64, value []byte, kind byte) {
+	if b.counter == blockRestartInterval {
+		b.counter = 0
+	}
+	shared := 0
+	if b.counter == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, kind)
+	b.buf = binary.AppendUvarint(b.buf, seq)
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.lastSeq = seq
+	b.counter++
+	b.entries++
+}
+
+// estimatedSize returns the size the block would have if finished now.
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart array and returns the encoded block.
+// The builder must be reset before it is reused.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+// reset empties the builder for the next block.
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+	b.lastSeq = 0
+	b.entries = 0
+}
+
+// blockIter is a cursor over the entries of one decoded block. The
+// key and value it exposes are only valid until it moves; value
+// points into the block itself.
+type blockIter struct {
+	data      []byte // entries, without the restart array
+	restarts  []byte // restart offsets, 4 bytes each
+	hasSeq    bool   // entries carry a sequence number (v5 and later)
+	next      int    // offset of the entry after the current one
+	key       []byte
+	seq       uint64
+	value     []byte
+	kind      byte
+	expiresAt int64
+	valid     bool
+	err       error
+}
+
+// newBlockIter prepares an iterator over an encoded block. It starts
+// out unpositioned. hasSeq is set for blocks of v5 and later tables.
+func newBlockIter(block []byte, hasSeq bool) (*blockIter, error) {
+	if len(block) < 4 {
+		return nil, errCorruptBlock
+	}
+	n := binary.LittleEndian.Uint32(block[len(block)-4:])
+	if uint64(n)*4+4 > uint64(len(block)) {
+		return nil, errCorruptBlock
+	}
+	restartsOff := len(block) - 4 - int(n)*4
+	return &blockIter{
+		data:     block[:restartsOff],
+		restarts: block[restartsOff : len(block)-4],
+		hasSeq:   hasSeq,
+	}, nil
+}
+
+func (bi *blockIter) numRestarts() int { return len(bi.restarts) / 4 }
+
+func (bi *blockIter) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(bi.restarts[4*i:]))
+}
+
+// seekToRestart positions the iterator just before restart point i,
+// so the next call to advance decodes the entry stored there.
+func (bi *blockIter) seekToRestart(i int) {
+	bi.key = bi.key[:0]
+	bi.next = bi.restart(i)
+	bi.valid = false
+}
+
+// first moves to the first entry in the block.
+func (bi *blockIter) first() {
+	if bi.numRestarts() == 0 {
+		bi.valid = false
+		return
+	}
+	bi.seekToRestart(0)
+	bi.advance()
+}
+
+// seek moves to the first entry at or after version seq of key in
+// internal order.
+func (bi *blockIter) seek(key string, seq uint64) {
+	// Find the last restart point before that position; every entry
+	// before it is too small.
+	n := bi.numRestarts()
+	if n == 0 {
+		bi.valid = false
+		return
+	}
+	i := sort.Search(n, func(i int) bool {
+		bi.seekToRestart(i)
+		bi.advance()
+		return !bi.valid || compareInternal(string(bi.key), bi.seq, key, seq) >= 0
+	})
+	if bi.err != nil {
+		bi.valid = false
+		return
+	}
+	if i > 0 {
+		i--
+	}
+	bi.seekToRestart(i)
+	for bi.advance(); bi.valid && compareInternal(string(bi.key), bi.seq, key, seq) < 0; bi.advance() {
+	}
+}
+
+// advance decodes the entry at bi.next.
+func (bi *blockIter) advance() {
+	if bi.next >= len(bi.data) {
+		bi.valid = false
+		return
+	}
+	p := bi.data[bi.next:]
+	shared, n1 := binary.Uvarint(p)
+	unshared, n2 := binary.Uvarint(p[max(n1, 0):])
+	valueLen, n3 := binary.Uvarint(p[max(n1+n2, 0):])
+	if n1 <= 0 || n2 <= 0 || n3 <= 0 {
+		bi.corrupt()
+		return
+	}
+	p = p[n1+n2+n3:]
+	if shared > uint64(len(bi.key)) || unshared > uint64(len(p)) || valueLen > uint64(len(p)) ||
+		uint64(len(p)) < 1+unshared+valueLen {
+		bi.corrupt()
+		return
+	}
+	bi.kind = p[0]
+	p = p[1:]
+	bi.seq = 0
+	if bi.hasSeq {
+		seq, n := binary.Uvarint(p)
+		if n <= 0 || uint64(len(p)-n) < unshared+valueLen {
+			bi.corrupt()
+			return
+		}
+		bi.seq = seq
+		p = p[n:]
+	}
+	bi.key = append(bi.key[:shared], p[:unshared]...)
+	bi.value = p[unshared : unshared+valueLen : unshared+valueLen]
+	bi.next = len(bi.data) - len(p) + int(unshared+valueLen)
+	bi.expiresAt = 0
+	if bi.kind == kindExpiringValue {
+		if len(bi.value) < 8 {
+			bi.corrupt()
+			return
+		}
+		bi.expiresAt = int64(binary.LittleEndian.Uint64(bi.value))
+		bi.value = bi.value[8:]
+	}
+	bi.valid = true
+}
+
+func (bi *blockIter) corrupt() {
+	bi.valid = false
+	bi.err = errCorruptBlock
+}
+
+// blockHandle locates a block within an SSTable.
+type blockHandle struct {
+	offset int64
+	size   int64
+}
+
+// encode returns the handle as an index block value.
+func (h blockHandle) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(h.offset))
+	return binary.AppendUvarint(buf, uint64(h.size))
+}
+
+// decodeBlockHandle parses a handle written by encode.
+func decodeBlockHandle(buf []byte) (blockHandle, error) {
+	offset, n1 := binary.Uvarint(buf)
+	if n1 <= 0 {
+		return blockHandle{}, errCorruptBlock
+	}
+	size, n2 := binary.Uvarint(buf[n1:])
+	if n2 <= 0 || n1+n2 != len(buf) {
+		return blockHandle{}, errCorruptBlock
+	}
+	return blockHandle{offset: int64(offset), size: int64(size)}, nil
+}
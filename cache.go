@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Block cache
+//
+// Point lookups and iterators read SSTable data one block at a time.
+// A BlockCache keeps recently used blocks in memory, already
+// decompressed, so hot keys don't pay a disk read and a decode on
+// every Get. Blocks are keyed by the owning database, the SSTable's
+// file number, and the block's offset in the file. The cache is
+// split into shards, each with its own lock and LRU list, so
+// concurrent readers rarely contend.
+
+// DefaultBlockCacheSize is the capacity of the block cache a
+// database creates when Options.BlockCache is not set.
+const DefaultBlockCacheSize = 8 * 1024 * 1024 // 8 MB
+
+// blockCacheShards is the number of independently locked shards.
+const blockCacheShards = 16
+
+// BlockCache is a sharded LRU cache of SSTable blocks with a byte
+// capacity. One cache can be shared by several databases through
+// Options.BlockCache to bound their combined memory. It is safe for
+// concurrent use.
+type BlockCache struct {
+	shards [blockCacheShards]cacheShard
+	nextNS atomic.Uint64
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// blockCacheKey identifies a block. ns separates databases sharing
+// the cache, whose file numbers overlap.
+type blockCacheKey struct {
+	ns     uint64
+	file   uint64
+	offset int64
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	lru      list.List // front is most recently used
+	items    map[blockCacheKey]*list.Element
+}
+
+type cacheEntry struct {
+	key   blockCacheKey
+	block []byte
+}
+
+// NewBlockCache returns a cache holding up to capacity bytes of
+// blocks.
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / blockCacheShards
+		c.shards[i].items = make(map[blockCacheKey]*list.Element)
+	}
+	return c
+}
+
+// newNamespace returns an ID that no other user of the cache has.
+func (c *BlockCache) newNamespace() uint64 {
+	return c.nextNS.Add(1)
+}
+
+func (c *BlockCache) shard(k blockCacheKey) *cacheShard {
+	h := k.ns*0x9E3779B97F4A7C15 ^ k.file*0xC2B2AE3D27D4EB4F ^ uint64(k.offset)*0x165667B19E3779F9
+	return &c.shards[h>>60]
+}
+
+// get returns the cached block for k and marks it recently used.
+func (c *BlockCache) get(k blockCacheKey) ([]byte, bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.items[k]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.Value.(*cacheEntry).block, true
+}
+
+// insert adds a block, evicting the least recently used blocks in
+// its shard to make room. Cached blocks are shared by every reader,
+// so they must never be modified. A block larger than a shard is not
+// cached.
+func (c *BlockCache) insert(k blockCacheKey, block []byte) {
+	s := c.shard(k)
+	size := int64(len(block))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size > s.capacity {
+		return
+	}
+	if e, ok := s.items[k]; ok {
+		// Another reader loaded the same block first.
+		s.lru.MoveToFront(e)
+		return
+	}
+	for s.used+size > s.capacity {
+		oldest := s.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.items, entry.key)
+		s.used -= int64(len(entry.block))
+	}
+	s.items[k] = s.lru.PushFront(&cacheEntry{key: k, block: block})
+	s.used += size
+}
+
+// Size returns the number of bytes of blocks currently cached.
+func (c *BlockCache) Size() int64 {
+	var n int64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.used
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Hits returns the number of lookups served from the cache.
+func (c *BlockCache) Hits() int64 { return c.hits.Load() }
+
+// Misses returns the number of lookups that had to read from disk.
+func (c *BlockCache) Misses() int64 { return c.misses.Load() }
@@ -0,0 +1,169 @@
+package lsm
+
+import "sync"
+
+// Group commit
+//
+// Every write goes through a commit queue. A writer enqueues its
+// encoded WAL payload and then either becomes the leader or waits.
+// The leader takes every payload queued so far, assigns sequence
+// numbers in queue order, writes the records with a single write
+// call and a single fsync, applies them to the memtable, publishes
+// the new last sequence number, and wakes the rest of the group with
+// the shared result. Writers that arrive while the leader is busy
+// queue up and form the next group, so under concurrency many writes
+// share one fsync. A lone writer still pays exactly one fsync, and no
+// write returns before its record is durable. The group is fsync'd if
+// any of its writers asked for a sync, so one SyncAlways-style write
+// makes every earlier record in the WAL durable too.
+//
+// A write may come with a check, which transactions use to detect
+// conflicts. The leader commits the writes queued before it, runs
+// the check once they are visible, and commits the write on its own
+// only if the check passes, so nothing can be written between the
+// check and the write.
+
+// writer is a single write waiting in the commit queue.
+type writer struct {
+	entries []WALEntry
+	payload []byte       // WAL payload for entries, without a sequence number
+	sync    bool         // fsync before acknowledging
+	check   func() error // if set, must pass before the write is logged
+	err     error
+	done    chan struct{} // closed once err is set
+}
+
+// commitQueue holds pending writers and the leader token.
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*writer
+	leader  chan struct{} // holds a token while a group is being committed
+}
+
+func newCommitQueue() commitQueue {
+	return commitQueue{leader: make(chan struct{}, 1)}
+}
+
+// write logs entries and applies them to the memtable. When batch
+// is set the entries are logged as one OpBatch record so recovery
+// applies all or none of them. wo may be nil.
+func (db *DB) write(entries []WALEntry, batch bool, wo *WriteOptions) error {
+	w, err := db.newWriter(entries, batch, wo)
+	if err != nil {
+		return err
+	}
+	return db.commit(w)
+}
+
+// newWriter prepares a write for the commit queue.
+func (db *DB) newWriter(entries []WALEntry, batch bool, wo *WriteOptions) (*writer, error) {
+	var payload []byte
+	if batch {
+		payload = encodeBatch(entries)
+		// The leader stamps sequence numbers on the entries, so
+		// leave the caller's batch alone.
+		entries = append([]WALEntry(nil), entries...)
+	} else {
+		payload = encodeEntry(nil, entries[0])
+	}
+	if err := checkRecordSize(sequenceHeaderSize+len(payload), db.opts.MaxWALRecordSize); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		entries: entries,
+		payload: payload,
+		sync:    wo.needsSync(db.opts.SyncMode),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// commit enqueues w and blocks until its group has been committed,
+// leading the group itself if no other writer is.
+func (db *DB) commit(w *writer) error {
+	q := &db.commits
+	q.mu.Lock()
+	q.pending = append(q.pending, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return w.err // a previous leader committed us
+	case q.leader <- struct{}{}:
+	}
+
+	q.mu.Lock()
+	group := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	for len(group) > 0 {
+		// Commit up to the next checked write, then that write alone.
+		n := 0
+		for n < len(group) && group[n].check == nil {
+			n++
+		}
+		var err error
+		if n == 0 {
+			n = 1
+			err = group[0].check()
+		}
+		if err == nil {
+			err = db.commitGroup(group[:n])
+		}
+		for _, g := range group[:n] {
+			g.err = err
+			close(g.done)
+		}
+		group = group[n:]
+	}
+	<-q.leader
+
+	<-w.done
+	return w.err
+}
+
+// commitGroup makes a group of writes durable and visible. Only the
+// current leader calls it, and the leader token also guards db.wal
+// against being swapped or closed underneath the write.
+func (db *DB) commitGroup(group []*writer) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	err := db.makeRoomForWrite()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	sync := false
+	seq := db.lastSeqNum.Load()
+	for _, w := range group {
+		for i := range w.entries {
+			w.entries[i].Seq = seq + 1 + uint64(i)
+		}
+		record, err := frameRecord(encodeSequence(seq+1, w.payload), db.opts.MaxWALRecordSize)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, record...)
+		seq += uint64(len(w.entries))
+		sync = sync || w.sync
+	}
+	if err := db.wal.write(buf, sync); err != nil {
+		return err
+	}
+	db.walWrites.Add(1)
+
+	// Only the leader swaps db.mem, and readers skip entries newer
+	// than the last sequence number, so the group is applied without
+	// db.mu and becomes visible all at once when it is published.
+	for _, w := range group {
+		applyEntries(db.mem, w.entries)
+	}
+	db.lastSeqNum.Store(seq)
+	return nil
+}
@@ -1,64 +1,167 @@
 package lsm
 
-// CompactionThreshold is the number of SSTables at a level that
-// triggers compaction into the next level.
+import (
+	"sort"
+	"time"
+)
+
+// CompactionThreshold is the default number of level-0 SSTables
+// that triggers compaction into level 1. It can be changed per
+// database with Options.CompactionThreshold.
 const CompactionThreshold = 4
 
 // Compact merges multiple SSTables into a single new SSTable.
 // Entries are merged in sorted order; when duplicate keys exist,
-// the entry from the SSTable with the higher sequence number
-// (earlier in the readers slice) wins — it's the most recent write.
+// only the newest version is kept: the one with the highest write
+// sequence number, or for tables written before sequence numbers,
+// the one from the SSTable earlier in the readers slice.
+//
+// Tombstones and expired values are removed during compaction since
+// all SSTables containing the key are being merged together.
 //
-// Tombstones are removed during compaction since all SSTables
-// containing the key are being merged together.
+// Merge operands are left as they are; see CompactWithMergeOperator.
 func Compact(readers []*SSTableReader, outputPath string) error {
+	return compact(readers, outputPath, nil, defaultTableOptions())
+}
+
+// CompactWithMergeOperator is Compact that also applies merge
+// operands to the values they modify.
+func CompactWithMergeOperator(readers []*SSTableReader, outputPath string, op MergeOperator) error {
+	return compact(readers, outputPath, op, defaultTableOptions())
+}
+
+func compact(readers []*SSTableReader, outputPath string, op MergeOperator, opts tableOptions) error {
+	// Remove tombstones — during compaction we can safely discard them
+	// because we're merging all SSTables that could contain these keys
+	live, rangeDels, err := mergeTables(readers, maxSeqNum, time.Now().UnixNano(), op, true)
+	if err != nil {
+		return err
+	}
+
+	// Even with no entries, create an empty SSTable for consistency.
+	// In practice we could skip this, but it simplifies the caller.
+	return writeSSTable(outputPath, live, rangeDels, opts)
+}
+
+// mergeTables reads every entry and range tombstone from readers
+// (newest first) and merges them, keeping the versions of each key
+// that a reader at sequence number oldest or later can still see
+// (see dropShadowed and dropCovered). Values expired at now become
+// tombstones, and merge operands are folded with op (see
+// mergeOperands). Tombstones of both kinds are dropped when
+// dropTombstones is set; that is only safe when no older table
+// outside readers could hold their keys. A damaged input fails the
+// merge rather than losing its entries.
+func mergeTables(readers []*SSTableReader, oldest uint64, now int64, op MergeOperator, dropTombstones bool) ([]SSTableEntry, []rangeTombstone, error) {
 	// Read all entries from each SSTable
 	allSets := make([][]SSTableEntry, len(readers))
+	var rangeDels []rangeTombstone
 	for i, r := range readers {
-		allSets[i] = r.ReadAll()
+		entries, err := r.ReadAll()
+		if err != nil {
+			return nil, nil, err
+		}
+		allSets[i] = entries
+		rangeDels = append(rangeDels, r.rangeDels...)
 	}
 
 	// Merge: k-way merge of sorted inputs
 	merged := kWayMerge(allSets)
+	expireEntries(merged, now)
+	merged, err := mergeOperands(op, merged, newRangeDelIndex(rangeDels, oldest), oldest, dropTombstones)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged = dropShadowed(merged, oldest, dropTombstones)
+	live, rangeDels := dropCovered(merged, rangeDels, oldest, dropTombstones)
+	return live, rangeDels, nil
+}
 
-	// Remove tombstones — during compaction we can safely discard them
-	// because we're merging all SSTables that could contain these keys
-	live := make([]SSTableEntry, 0, len(merged))
-	for _, e := range merged {
-		if !e.Tombstone {
-			live = append(live, e)
+// tableRun is the contents of one compaction output table.
+type tableRun struct {
+	entries   []SSTableEntry
+	rangeDels []rangeTombstone
+}
+
+// splitEntries cuts sorted entries into consecutive runs of roughly
+// targetSize bytes each, so a compaction produces several files
+// with disjoint key ranges instead of one ever-growing file. Runs
+// are only cut between keys, so every version of a key lands in the
+// same file, and never where a range tombstone would straddle the
+// cut; each tombstone goes to the run its range falls in. A
+// targetSize of 0 keeps everything in one run.
+func splitEntries(entries []SSTableEntry, rangeDels []rangeTombstone, targetSize int64) []tableRun {
+	if len(entries) == 0 && len(rangeDels) == 0 {
+		return nil
+	}
+	if targetSize == 0 {
+		return []tableRun{{entries: entries, rangeDels: rangeDels}}
+	}
+	var runs []tableRun
+	start := 0
+	var size int64
+	for i, e := range entries {
+		size += int64(4 + len(e.Key) + 4 + len(e.Value) + 1)
+		if size < targetSize || i+1 == len(entries) {
+			continue
 		}
+		if next := entries[i+1].Key; next == e.Key || straddles(rangeDels, e.Key, next) {
+			continue
+		}
+		runs = append(runs, tableRun{entries: entries[start : i+1]})
+		start = i + 1
+		size = 0
+	}
+	if start < len(entries) || len(runs) == 0 {
+		runs = append(runs, tableRun{entries: entries[start:]})
 	}
 
-	// Write the merged entries if there are any
-	if len(live) == 0 {
-		// Even with no entries, create an empty SSTable for consistency.
-		// In practice we could skip this, but it simplifies the caller.
-		return WriteSSTable(outputPath, live)
+	// Every run but the last has entries, and no tombstone reaches
+	// past its last key into the next run.
+	for _, t := range rangeDels {
+		i := sort.Search(len(runs)-1, func(i int) bool {
+			last := runs[i].entries[len(runs[i].entries)-1]
+			return last.Key >= t.start
+		})
+		runs[i].rangeDels = append(runs[i].rangeDels, t)
 	}
+	return runs
+}
 
-	return WriteSSTable(outputPath, live)
+// straddles reports whether a range tombstone reaches across a cut
+// between keys prev and next, which would make the tables on either
+// side overlap.
+func straddles(rangeDels []rangeTombstone, prev, next string) bool {
+	for _, t := range rangeDels {
+		if t.start <= next && t.end > prev {
+			return true
+		}
+	}
+	return false
 }
 
-// kWayMerge merges k sorted slices into one sorted slice.
-// When the same key appears in multiple slices, the entry from the
-// slice with the lowest index wins (that's the newest SSTable).
+// kWayMerge merges k slices in internal order into one, keeping
+// every version of each key. When the same version appears in
+// multiple slices, which only happens for data written before
+// sequence numbers, the entry from the slice with the lowest index
+// wins (that's the newest SSTable).
 func kWayMerge(sets [][]SSTableEntry) []SSTableEntry {
 	// Track current position in each set
 	positions := make([]int, len(sets))
 	var result []SSTableEntry
 
 	for {
-		// Find the smallest key across all sets
-		minKey := ""
+		// Find the smallest version across all sets; the first set
+		// holding it wins
+		var winner SSTableEntry
 		minSet := -1
 		for i, pos := range positions {
 			if pos >= len(sets[i]) {
 				continue // this set is exhausted
 			}
-			key := sets[i][pos].Key
-			if minSet == -1 || key < minKey {
-				minKey = key
+			e := sets[i][pos]
+			if minSet == -1 || compareInternal(e.Key, e.Seq, winner.Key, winner.Seq) < 0 {
+				winner = e
 				minSet = i
 			}
 		}
@@ -67,20 +170,13 @@ func kWayMerge(sets [][]SSTableEntry) []SSTableEntry {
 			break // all sets exhausted
 		}
 
-		// Collect the entry from the newest set (lowest index) that
-		// has this key, and advance all sets past this key
-		var winner SSTableEntry
-		winnerIdx := -1
+		// Advance every set holding this version past it
 		for i, pos := range positions {
 			if pos >= len(sets[i]) {
 				continue
 			}
-			if sets[i][pos].Key == minKey {
-				if winnerIdx == -1 || i < winnerIdx {
-					winner = sets[i][pos]
-					winnerIdx = i
-				}
-				positions[i]++ // advance past this key in every set
+			if e := sets[i][pos]; e.Key == winner.Key && e.Seq == winner.Seq {
+				positions[i]++
 			}
 		}
 
@@ -0,0 +1,211 @@
+package lsm
+
+import "fmt"
+
+// Compaction strategies
+//
+// A CompactionStrategy decides which SSTables to merge and where the
+// result goes. The strategy is chosen per database with
+// Options.CompactionStrategy; the merge itself, installing the
+// outputs, and deleting the inputs are the same for every strategy
+// (see maybeCompact).
+//
+// Strategies also decide the shape of each level. In a disjoint
+// level tables are sorted by key and never overlap, so a lookup
+// checks at most one of them. Any other level is a stack of runs,
+// newest first, whose key ranges may overlap. Level 0 is always a
+// stack of runs.
+
+// CompactionStrategy decides which SSTables a database compacts. It
+// is one of a fixed set of built-in strategies, not an interface, as
+// a strategy works on the database's internal level layout; the zero
+// value is LeveledStrategy. A database can be reopened with a
+// different strategy; levels that no longer fit the new strategy's
+// shape are repaired on Open.
+type CompactionStrategy int
+
+const (
+	// LeveledStrategy keeps every level from 1 up sorted and
+	// non-overlapping, with a byte target per level (see levels.go).
+	// Level 0 is pushed into level 1 once it has CompactionThreshold
+	// tables; a deeper level over its target pushes one table into
+	// the level below, together with the tables it overlaps there.
+	// Reads touch few tables, at the cost of rewriting data once per
+	// level. This is the default.
+	LeveledStrategy CompactionStrategy = iota
+	// SizeTieredStrategy lets runs pile up and merges them only when
+	// enough of a similar size have accumulated, which keeps write
+	// amplification low for ingest-heavy workloads at the cost of
+	// more tables to check on reads. Each level is a tier of runs:
+	// flushes land in level 0, and once a level holds
+	// CompactionThreshold runs they are merged into one run at the
+	// next level, which therefore holds runs roughly
+	// CompactionThreshold times larger. The last level merges its
+	// runs in place.
+	SizeTieredStrategy
+	// MergeAllStrategy merges every SSTable in the database into
+	// level 1 whenever level 0 reaches CompactionThreshold tables. It
+	// is the simplest policy and keeps reads cheap, but each
+	// compaction rewrites the whole database.
+	MergeAllStrategy
+)
+
+func (s CompactionStrategy) String() string {
+	switch s {
+	case LeveledStrategy:
+		return "leveled"
+	case SizeTieredStrategy:
+		return "size-tiered"
+	case MergeAllStrategy:
+		return "merge-all"
+	}
+	return fmt.Sprintf("CompactionStrategy(%d)", int(s))
+}
+
+// pick returns the next compaction, or nil if none is needed. It
+// does not modify the database. Called with db.mu held.
+func (s CompactionStrategy) pick(db *DB) *compaction {
+	switch s {
+	case SizeTieredStrategy:
+		return pickSizeTiered(db)
+	case MergeAllStrategy:
+		return pickMergeAll(db)
+	}
+	return pickLeveled(db)
+}
+
+// disjoint reports whether tables in level are kept sorted by key
+// with non-overlapping ranges.
+func (s CompactionStrategy) disjoint(level int) bool {
+	return s != SizeTieredStrategy && level > 0
+}
+
+// compaction describes one unit of compaction work.
+type compaction struct {
+	level          int          // level the compaction was scored on
+	inputs         []*tableMeta // tables to merge, newest data first
+	outputLevel    int          // level the merged tables go to
+	split          bool         // cut the output at TargetFileSize
+	dropTombstones bool         // no table outside inputs can hold an older version
+}
+
+// pickLeveled scores level 0 by its table count and each deeper
+// level by its size against its target, and compacts the level with
+// the highest score of at least 1.
+func pickLeveled(db *DB) *compaction {
+	level, bestScore := -1, 1.0
+	if score := float64(len(db.levels[0])) / float64(db.opts.CompactionThreshold); score >= bestScore {
+		level, bestScore = 0, score
+	}
+	// The last level has nowhere to compact into.
+	for l := 1; l < len(db.levels)-1; l++ {
+		score := float64(levelBytes(db.levels[l])) / float64(db.opts.levelTarget(l))
+		if score > bestScore {
+			level, bestScore = l, score
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+
+	var inputs []*tableMeta
+	if level == 0 {
+		// Level-0 tables overlap each other, so they all go together.
+		inputs = append(inputs, db.levels[0]...)
+	} else {
+		inputs = append(inputs, pickTable(db.levels[level], db.compactPointer[level]))
+	}
+	smallest, largest := keyRange(inputs)
+	inputs = append(inputs, overlapping(db.levels[level+1], smallest, largest)...)
+
+	return &compaction{
+		level:          level,
+		inputs:         inputs,
+		outputLevel:    level + 1,
+		split:          true,
+		dropTombstones: !db.overlapsBelow(level+1, inputs),
+	}
+}
+
+// pickTable chooses the next table to push down from a level >= 1.
+// It walks the level round-robin by key, starting after pointer, so
+// that every part of the key space gets compacted in turn.
+func pickTable(tables []*tableMeta, pointer string) *tableMeta {
+	for _, t := range tables {
+		if t.smallest > pointer {
+			return t
+		}
+	}
+	return tables[0]
+}
+
+// pickSizeTiered merges the runs of the shallowest level holding at
+// least CompactionThreshold of them.
+func pickSizeTiered(db *DB) *compaction {
+	for level, tables := range db.levels {
+		if len(tables) < db.opts.CompactionThreshold {
+			continue
+		}
+		out := level + 1
+		if out == len(db.levels) {
+			if len(tables) < 2 {
+				continue // a single run is already merged
+			}
+			out = level
+		}
+		inputs := append([]*tableMeta(nil), tables...)
+		return &compaction{
+			level:       level,
+			inputs:      inputs,
+			outputLevel: out,
+			// Runs already in the output tier are older than the
+			// inputs, so they count as below them here.
+			dropTombstones: !db.overlapsBelow(level, inputs),
+		}
+	}
+	return nil
+}
+
+// pickMergeAll merges every table into level 1 once level 0 is full.
+func pickMergeAll(db *DB) *compaction {
+	if len(db.levels[0]) < db.opts.CompactionThreshold {
+		return nil
+	}
+	var inputs []*tableMeta
+	for _, tables := range db.levels {
+		inputs = append(inputs, tables...)
+	}
+	return &compaction{
+		level:          0,
+		inputs:         inputs,
+		outputLevel:    1,
+		split:          true,
+		dropTombstones: true,
+	}
+}
+
+// overlapsBelow reports whether any table deeper than level, other
+// than the inputs themselves, overlaps the inputs' key range. If
+// none does, the inputs hold the oldest version of every key they
+// contain. Called with db.mu held.
+func (db *DB) overlapsBelow(level int, inputs []*tableMeta) bool {
+	smallest, largest := keyRange(inputs)
+	for l := level + 1; l < len(db.levels); l++ {
+		for _, t := range overlapping(db.levels[l], smallest, largest) {
+			if !containsTable(inputs, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsTable reports whether t is one of tables.
+func containsTable(tables []*tableMeta, t *tableMeta) bool {
+	for _, u := range tables {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
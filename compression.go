@@ -0,0 +1,251 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Block compression
+//
+// Every block of a v3 SSTable ends with one byte holding the ID of
+// the Compressor that compressed it, or 0 if it is stored as is. A
+// table can therefore mix codecs, and a reader decompresses each
+// block with whatever codec wrote it, whatever the database is
+// configured with today. A block that doesn't shrink by at least an
+// eighth is stored uncompressed rather than paying to decompress it.
+
+// Compressor compresses SSTable blocks. The built-in compressors are
+// NoCompression, FlateCompressor, and ZlibCompressor, all built on
+// the standard library. A custom Compressor must be registered with
+// RegisterCompressor before any table it wrote is read.
+type Compressor interface {
+	// ID identifies the codec on disk. IDs below 16 are reserved
+	// for the built-in compressors.
+	ID() byte
+	// Compress returns the compressed form of src.
+	Compress(src []byte) ([]byte, error)
+	// Decompress reverses Compress.
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Built-in compressor IDs.
+const (
+	noCompressionID    byte = 0
+	flateCompressionID byte = 1
+	zlibCompressionID  byte = 2
+	firstCustomID      byte = 16
+)
+
+// NoCompression stores blocks uncompressed. It is the default.
+var NoCompression Compressor = noCompressor{}
+
+type noCompressor struct{}
+
+func (noCompressor) ID() byte                              { return noCompressionID }
+func (noCompressor) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (noCompressor) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+// FlateCompressor compresses blocks with raw DEFLATE (compress/flate).
+// Level is a compress/flate level; 0 means flate.DefaultCompression.
+type FlateCompressor struct {
+	Level int
+}
+
+func (FlateCompressor) ID() byte { return flateCompressionID }
+
+func (c FlateCompressor) Compress(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	pool := flateWriters.pool(level)
+	var buf bytes.Buffer
+	w, ok := pool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, level); err != nil {
+			return nil, err
+		}
+	}
+	defer pool.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (FlateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// ZlibCompressor compresses blocks with zlib (compress/zlib), which
+// adds an Adler-32 checksum to DEFLATE. Level is a compress/flate
+// level; 0 means zlib.DefaultCompression.
+type ZlibCompressor struct {
+	Level int
+}
+
+func (ZlibCompressor) ID() byte { return zlibCompressionID }
+
+func (c ZlibCompressor) Compress(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = zlib.DefaultCompression
+	}
+	pool := zlibWriters.pool(level)
+	var buf bytes.Buffer
+	w, ok := pool.Get().(*zlib.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = zlib.NewWriterLevel(&buf, level); err != nil {
+			return nil, err
+		}
+	}
+	defer pool.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ZlibCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// DEFLATE writers allocate several hundred KB each, far more than a
+// block, so they are pooled per level.
+type writerPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func (p *writerPool) pool(level int) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pools == nil {
+		p.pools = make(map[int]*sync.Pool)
+	}
+	if p.pools[level] == nil {
+		p.pools[level] = &sync.Pool{}
+	}
+	return p.pools[level]
+}
+
+var (
+	flateWriters writerPool
+	zlibWriters  writerPool
+	flateReaders = sync.Pool{New: func() any { return flate.NewReader(nil) }}
+)
+
+var registry = struct {
+	sync.RWMutex
+	compressors map[byte]Compressor
+}{compressors: map[byte]Compressor{
+	noCompressionID:    NoCompression,
+	flateCompressionID: FlateCompressor{},
+	zlibCompressionID:  ZlibCompressor{},
+}}
+
+// RegisterCompressor makes a custom Compressor available for reading
+// the blocks it wrote. Its ID must not be reserved or already taken.
+func RegisterCompressor(c Compressor) error {
+	id := c.ID()
+	if id < firstCustomID {
+		return fmt.Errorf("compressor id %d is reserved", id)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.compressors[id]; ok {
+		return fmt.Errorf("compressor id %d is already registered", id)
+	}
+	registry.compressors[id] = c
+	return nil
+}
+
+// lookupCompressor returns the compressor registered for id.
+func lookupCompressor(id byte) (Compressor, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	c, ok := registry.compressors[id]
+	return c, ok
+}
+
+// checkRegistered reports an error unless c is the compressor
+// registered for its ID, so that tables it writes can be read back.
+// A built-in compressor may differ from the registered one in its
+// Level, which doesn't affect decompression.
+func checkRegistered(c Compressor) error {
+	id := c.ID()
+	r, ok := lookupCompressor(id)
+	if !ok {
+		return fmt.Errorf("compressor id %d is not registered", id)
+	}
+	if reflect.TypeOf(r) != reflect.TypeOf(c) ||
+		id >= firstCustomID && reflect.TypeOf(c).Comparable() && r != c {
+		return fmt.Errorf("compressor id %d is registered to a different compressor", id)
+	}
+	return nil
+}
+
+// compressBlock compresses a finished block with c and appends the
+// ID byte, falling back to storing it as is when compression doesn't
+// pay. It may reuse raw's backing array.
+func compressBlock(raw []byte, c Compressor) ([]byte, error) {
+	if c.ID() != noCompressionID {
+		compressed, err := c.Compress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("compress block: %w", err)
+		}
+		if len(compressed) < len(raw)-len(raw)/8 {
+			return append(compressed, c.ID()), nil
+		}
+	}
+	return append(raw, noCompressionID), nil
+}
+
+// decompressBlock strips the ID byte from a stored block and
+// decompresses it with the codec it names.
+func decompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) < 1 {
+		return nil, errCorruptBlock
+	}
+	id := stored[len(stored)-1]
+	body := stored[:len(stored)-1]
+	if id == noCompressionID {
+		return body, nil
+	}
+	c, ok := lookupCompressor(id)
+	if !ok {
+		return nil, fmt.Errorf("sstable: unknown compressor id %d", id)
+	}
+	block, err := c.Decompress(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompress: %v", errCorruptBlock, err)
+	}
+	return block, nil
+}
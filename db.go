@@ -1,102 +1,233 @@
 package lsm
 
 import (
+	"bytes"
+	"container/list"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
 // DB is the top-level LSM tree database. It provides a simple
 // key-value interface backed by a write-ahead log, an in-memory
 // sorted buffer (memtable), and sorted string tables (SSTables)
 // on disk.
+//
+// A DB is safe for concurrent use by multiple goroutines. Reads
+// (Get, NewIterator, Stats) run in parallel with each other. Writes
+// (Put, Delete, Write) are funneled through a group commit queue
+// (see commit.go): they are logged in arrival order, each with its
+// own sequence number, and a reader only sees writes up to the last
+// sequence number published when it started (see snapshot.go), so
+// it never sees part of a batch. Full memtables are flushed by a
+// background goroutine (see flush.go), and a flushed memtable is
+// swapped for its SSTable under the same lock, so readers never
+// observe a partially swapped SSTable list. Compactions install
+// their outputs the same way. Iterators read from the SSTables they
+// captured at creation and are not affected by later writes, but a
+// single Iterator must not be used from several goroutines at once.
 type DB struct {
 	dir      string
-	wal      *WAL
-	mem      *Memtable
-	sstables []*SSTableReader // newest first
-	nextSeq  int              // next SSTable sequence number
+	opts     *Options
+	commits  commitQueue // orders writers; the leader may write to wal
+	manifest *manifest   // set during Open; serializes its own edits
+
+	blockCache *BlockCache // possibly shared with other databases
+	cacheNS    uint64      // this database's namespace in blockCache
+	tables     *tableCache // open SSTable readers, keyed by seq
+
+	lastSeqNum atomic.Uint64 // last sequence number visible to reads
+
+	walWrites   atomic.Int64 // group commits written to the WAL
+	compactions atomic.Int64 // completed compactions
+
+	bgStop    chan struct{} // closed to stop background goroutines
+	bgWG      sync.WaitGroup
+	stopOnce  sync.Once
+	flushCh   chan struct{} // wakes the flusher
+	compactCh chan struct{} // wakes the compaction worker
+
+	mu        sync.RWMutex // guards the fields below
+	flushCond *sync.Cond   // signaled when an immutable memtable is flushed
+	closed    bool
+	bgErr     error // sticky background flush error
+	wal       *WAL
+	mem       *Memtable
+	imm       []*immutable   // frozen memtables awaiting flush, newest first
+	logNum    int            // WAL segment the active memtable logs to
+	minLogNum int            // oldest WAL segment not yet flushed
+	levels    [][]*tableMeta // see levels.go
+	nextSeq   int            // next SSTable or WAL segment number
+	snapshots list.List      // live *Snapshot, oldest first
+
+	// compactPointer[n] is the largest key of the last level-n table
+	// compacted, so the next compaction of level n starts after it.
+	compactPointer []string
 }
 
 // ErrKeyNotFound is returned when a key doesn't exist.
 var ErrKeyNotFound = fmt.Errorf("key not found")
 
-// Open opens or creates a database at the given directory path.
-// On startup it replays the WAL to recover any writes that weren't
-// flushed to SSTables, and loads existing SSTables.
+// ErrClosed is returned by operations on a closed database.
+var ErrClosed = fmt.Errorf("db closed")
+
+// ErrCorruption is returned, wrapped with details, when stored data
+// fails its checksum or does not decode. Test for it with errors.Is.
+var ErrCorruption = fmt.Errorf("corruption")
+
+// Open opens or creates a database at the given directory path
+// using DefaultOptions.
 func Open(dir string) (*DB, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	return OpenWithOptions(dir, nil)
+}
+
+// OpenWithOptions opens or creates a database at the given directory
+// path. A nil opts uses DefaultOptions; zero-valued fields fall back
+// to their defaults. On startup it loads existing SSTables and replays
+// the WAL segments to recover any writes that weren't flushed to
+// SSTables.
+func OpenWithOptions(dir string, opts *Options) (*DB, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, opts.DirMode); err != nil {
 		return nil, fmt.Errorf("db mkdir: %w", err)
 	}
 
 	db := &DB{
-		dir:     dir,
-		mem:     NewMemtable(DefaultMemtableSize),
-		nextSeq: 1,
+		dir:            dir,
+		opts:           opts,
+		levels:         make([][]*tableMeta, opts.NumLevels),
+		compactPointer: make([]string, opts.NumLevels),
+		nextSeq:        1,
+		commits:        newCommitQueue(),
+		bgStop:         make(chan struct{}),
+		flushCh:        make(chan struct{}, 1),
+		compactCh:      make(chan struct{}, 1),
+	}
+	db.flushCond = sync.NewCond(&db.mu)
+	db.mem = db.newMemtable()
+	db.blockCache = opts.BlockCache
+	if db.blockCache == nil {
+		db.blockCache = NewBlockCache(opts.BlockCacheSize)
 	}
+	db.cacheNS = db.blockCache.newNamespace()
+	db.tables = newTableCache(opts.MaxOpenTables, db.openTable)
 
 	// Load existing SSTables
 	if err := db.loadSSTables(); err != nil {
 		return nil, fmt.Errorf("db load sstables: %w", err)
 	}
 
-	// Replay WAL into memtable for crash recovery
-	walPath := filepath.Join(dir, "wal")
-	entries, err := Replay(walPath)
-	if err != nil {
-		return nil, fmt.Errorf("db replay wal: %w", err)
-	}
-	for _, e := range entries {
-		switch e.Op {
-		case OpPut:
-			db.mem.Put(string(e.Key), e.Value)
-		case OpDelete:
-			db.mem.Delete(string(e.Key))
-		}
+	// Replay the WAL segments for crash recovery and start a new one
+	// for writes. Memtables that were waiting to be flushed when we
+	// last stopped are queued for the flusher again.
+	if err := db.recoverWAL(); err != nil {
+		return nil, fmt.Errorf("db recover wal: %w", err)
 	}
 
-	// Open WAL for new writes
-	wal, err := OpenWAL(walPath)
-	if err != nil {
-		return nil, fmt.Errorf("db open wal: %w", err)
+	db.bgWG.Add(2)
+	go db.flushLoop()
+	go db.compactLoop()
+	if len(db.imm) > 0 {
+		db.scheduleFlush()
+	}
+	db.scheduleCompaction()
+	if opts.SyncMode == SyncInterval {
+		db.bgWG.Add(1)
+		go db.syncLoop()
 	}
-	db.wal = wal
 
 	return db, nil
 }
 
-// Put writes a key-value pair to the database.
-// The write is durable as soon as this returns — it's in the WAL.
+// Put writes a key-value pair to the database. Under the default
+// SyncAlways mode the write is durable as soon as this returns —
+// it's in the WAL.
 func (db *DB) Put(key string, value []byte) error {
-	if err := db.wal.Append(WALEntry{Op: OpPut, Key: []byte(key), Value: value}); err != nil {
-		return err
-	}
-	db.mem.Put(key, value)
-	if db.mem.IsFull() {
-		return db.flush()
-	}
-	return nil
+	return db.PutWithOptions(key, value, nil)
+}
+
+// PutWithOptions is Put with a per-write sync override.
+func (db *DB) PutWithOptions(key string, value []byte, wo *WriteOptions) error {
+	return db.write([]WALEntry{{Op: OpPut, Key: []byte(key), Value: value}}, false, wo)
 }
 
 // Get reads a value by key. Returns ErrKeyNotFound if the key
-// doesn't exist or was deleted.
+// doesn't exist or was deleted, and an error wrapping ErrCorruption
+// if an SSTable holding it is damaged.
 func (db *DB) Get(key string) ([]byte, error) {
-	// Check memtable first (most recent data)
-	if val, found := db.mem.Get(key); found {
-		if val == nil {
-			return nil, ErrKeyNotFound // tombstone
+	return db.GetWithOptions(key, nil)
+}
+
+// GetWithOptions is Get with per-read options.
+func (db *DB) GetWithOptions(key string, ro *ReadOptions) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	seq := ro.readSeq(db)
+	now := db.now()
+
+	// The newest version decides, unless it is a merge operand that
+	// needs the older versions too.
+	resolve := func(val []byte, kind EntryKind) ([]byte, error) {
+		switch kind {
+		case KindTombstone:
+			return nil, ErrKeyNotFound
+		case KindMerge:
+			return db.getMerged(key, ro)
 		}
 		return val, nil
 	}
 
-	// Check SSTables from newest to oldest
-	for _, sst := range db.sstables {
-		val, tombstone, found := sst.Get(key)
-		if found {
-			if tombstone {
-				return nil, ErrKeyNotFound
+	// Check memtables first (most recent data)
+	if val, kind, found := db.mem.get(key, seq, now); found {
+		return resolve(val, kind)
+	}
+	for _, imm := range db.imm {
+		if val, kind, found := imm.mem.get(key, seq, now); found {
+			return resolve(val, kind)
+		}
+	}
+
+	// Check SSTables from newest to oldest. Tables in a level of
+	// overlapping runs are each checked in turn; a disjoint level has
+	// at most one candidate.
+	for level, tables := range db.levels {
+		candidates := tables
+		if db.opts.CompactionStrategy.disjoint(level) {
+			t := findTable(tables, key)
+			if t == nil {
+				continue
+			}
+			candidates = []*tableMeta{t}
+		}
+		for _, t := range candidates {
+			if !t.contains(key) {
+				continue
+			}
+			r, err := db.tables.get(t)
+			if err != nil {
+				return nil, fmt.Errorf("db get: %w", err)
+			}
+			val, kind, found, err := r.get(key, seq, now, ro.verifyChecksums())
+			r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("db get: %w", err)
+			}
+			if found {
+				if kind == KindValue {
+					// val points into a block the cache shares
+					// with other readers, so the caller gets a copy.
+					val = bytes.Clone(val)
+				}
+				return resolve(val, kind)
 			}
-			return val, nil
 		}
 	}
 
@@ -105,43 +236,176 @@ func (db *DB) Get(key string) ([]byte, error) {
 
 // Delete removes a key by writing a tombstone marker.
 func (db *DB) Delete(key string) error {
-	if err := db.wal.Append(WALEntry{Op: OpDelete, Key: []byte(key)}); err != nil {
-		return err
+	return db.DeleteWithOptions(key, nil)
+}
+
+// DeleteWithOptions is Delete with a per-write sync override.
+func (db *DB) DeleteWithOptions(key string, wo *WriteOptions) error {
+	return db.write([]WALEntry{{Op: OpDelete, Key: []byte(key)}}, false, wo)
+}
+
+// Write applies every operation in the batch atomically. Operations
+// are applied in the order they were added, so a later write to the
+// same key wins. An empty batch is a no-op.
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions is Write with a per-write sync override.
+func (db *DB) WriteWithOptions(batch *WriteBatch, wo *WriteOptions) error {
+	if batch == nil || batch.Count() == 0 {
+		return nil
 	}
-	db.mem.Delete(key)
-	if db.mem.IsFull() {
-		return db.flush()
+	if batch.err != nil {
+		return fmt.Errorf("db write: %w", batch.err)
 	}
-	return nil
+	return db.write(db.stampExpiry(batch.entries), true, wo)
 }
 
-// Close flushes the memtable and closes all resources.
-func (db *DB) Close() error {
+// SyncWAL fsyncs every write logged so far. It is useful under
+// SyncInterval or SyncNever to create a durability point.
+func (db *DB) SyncWAL() error {
+	// Act as the commit leader so the sync never races with a group
+	// write or a WAL swap.
+	db.commits.leader <- struct{}{}
+	defer func() { <-db.commits.leader }()
+
+	if db.closed {
+		return ErrClosed
+	}
+	return db.wal.Sync()
+}
+
+// Flush freezes the active memtable and waits until it and every
+// other queued memtable have been written to SSTables.
+func (db *DB) Flush() error {
+	db.commits.leader <- struct{}{}
+	defer func() { <-db.commits.leader }()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
 	if db.mem.Len() > 0 {
-		if err := db.flush(); err != nil {
+		for len(db.imm) >= db.opts.MaxImmutableMemtables && db.bgErr == nil {
+			db.flushCond.Wait()
+		}
+		if db.bgErr != nil {
+			return db.bgErr
+		}
+		if err := db.rotateMemtable(); err != nil {
 			return err
 		}
 	}
-	for _, sst := range db.sstables {
-		sst.Close()
+	for len(db.imm) > 0 && db.bgErr == nil {
+		db.flushCond.Wait()
 	}
-	return db.wal.Close()
+	return db.bgErr
+}
+
+// Close flushes the memtables and closes all resources. Calling
+// Close more than once returns ErrClosed.
+func (db *DB) Close() error {
+	// Take the commit leader token so no group is mid-write. A writer
+	// stalled on a full queue still has the flusher to wake it.
+	db.commits.leader <- struct{}{}
+	defer func() { <-db.commits.leader }()
+	if db.closed {
+		return ErrClosed
+	}
+	db.stopBackground()
+
+	// Freeze the active memtable and finish what the flusher left.
+	db.mu.Lock()
+	db.closed = true
+	err := db.wal.Close()
+	if db.mem.Len() > 0 {
+		// No segment will ever have this number, so flushing the
+		// memtable retires the active segment too.
+		db.imm = append([]*immutable{{mem: db.mem, logNum: db.nextSeq}}, db.imm...)
+		db.nextSeq++
+		db.mem = db.newMemtable()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		flushed, err := db.flushOldestImmutable()
+		if err != nil {
+			return err
+		}
+		if !flushed {
+			break
+		}
+	}
+
+	db.tables.close()
+	return db.manifest.close()
 }
 
 // Stats returns diagnostic information about the database.
 func (db *DB) Stats() DBStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	levels := make([]LevelStats, len(db.levels))
+	numSSTables := 0
+	for i, tables := range db.levels {
+		levels[i] = LevelStats{Files: len(tables), Bytes: levelBytes(tables)}
+		numSSTables += len(tables)
+	}
+	immutableSize := 0
+	for _, imm := range db.imm {
+		immutableSize += imm.mem.Size()
+	}
 	return DBStats{
-		NumSSTables:   len(db.sstables),
+		NumSSTables:   numSSTables,
+		NumImmutable:  len(db.imm),
+		ImmutableSize: immutableSize,
 		MemtableSize:  db.mem.Size(),
 		MemtableCount: db.mem.Len(),
 		WALSize:       db.wal.Size(),
+		WALWrites:     db.walWrites.Load(),
+		Compactions:   db.compactions.Load(),
+		Levels:        levels,
+		OpenTables:    db.tables.len(),
+		BlockCache: BlockCacheStats{
+			Hits:   db.blockCache.Hits(),
+			Misses: db.blockCache.Misses(),
+			Bytes:  db.blockCache.Size(),
+		},
 	}
 }
 
 // DBStats holds database diagnostic information.
 type DBStats struct {
 	NumSSTables   int
-	MemtableSize  int
+	NumImmutable  int // full memtables waiting for the background flusher
+	ImmutableSize int // bytes allocated by those memtables
+	MemtableSize  int // bytes allocated by the active memtable
 	MemtableCount int
 	WALSize       int64
+	WALWrites     int64 // WAL write+fsync rounds; fewer than writes under group commit
+	Compactions   int64 // background compactions completed
+	Levels        []LevelStats
+	OpenTables    int // SSTable readers held by the table cache
+	BlockCache    BlockCacheStats
+}
+
+// BlockCacheStats describes the block cache. When the cache is
+// shared through Options.BlockCache, the counters cover every
+// database using it.
+type BlockCacheStats struct {
+	Hits   int64
+	Misses int64
+	Bytes  int64 // decoded blocks currently cached
+}
+
+// LevelStats describes the SSTables in one level.
+type LevelStats struct {
+	Files int
+	Bytes int64
 }
@@ -3,6 +3,7 @@ package lsm
 import (
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"testing"
 )
 
@@ -24,6 +25,32 @@ func BenchmarkSequentialWrites(b *testing.B) {
 	}
 }
 
+func BenchmarkParallelWrites(b *testing.B) {
+	dir := b.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var counter atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := counter.Add(1)
+			key := fmt.Sprintf("bench-key-%08d", i)
+			val := fmt.Sprintf("bench-val-%08d", i)
+			if err := db.Put(key, []byte(val)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/float64(db.Stats().WALWrites), "writes/fsync")
+}
+
 func BenchmarkRandomReads(b *testing.B) {
 	dir := b.TempDir()
 	db, err := Open(dir)
@@ -79,3 +106,17 @@ func BenchmarkMixedWorkload(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkMemtableRandomPut(b *testing.B) {
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench-key-%08d", rand.Intn(b.N))
+	}
+	value := []byte("bench-value")
+	m := NewMemtable(DefaultMemtableSize)
+
+	b.ResetTimer()
+	for _, key := range keys {
+		m.Put(key, value)
+	}
+}
@@ -2,218 +2,503 @@ package lsm
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// flush writes the current memtable to a new level-0 SSTable,
-// resets the WAL, and triggers compaction if needed.
-func (db *DB) flush() error {
-	// Convert memtable entries to SSTable entries
-	memEntries := db.mem.Entries()
-	sstEntries := make([]SSTableEntry, len(memEntries))
-	for i, e := range memEntries {
-		sstEntries[i] = SSTableEntry{
-			Key:       e.key,
-			Value:     e.value,
-			Tombstone: e.tombstone,
+// applyEntries adds logged operations to a memtable at their
+// sequence numbers.
+func applyEntries(m *Memtable, entries []WALEntry) {
+	for _, e := range entries {
+		switch e.Op {
+		case OpPut:
+			m.putExpiring(string(e.Key), e.Seq, e.Value, e.ExpiresAt)
+		case OpDelete:
+			m.delete(string(e.Key), e.Seq)
+		case OpMerge:
+			m.merge(string(e.Key), e.Seq, e.Value)
+		case OpDeleteRange:
+			m.deleteRange(string(e.Key), string(e.Value), e.Seq)
 		}
 	}
+}
 
-	// Write the new SSTable at level 0
-	path := db.sstPath(0, db.nextSeq)
-	if err := WriteSSTable(path, sstEntries); err != nil {
-		return fmt.Errorf("db flush: %w", err)
+// scheduleCompaction wakes the compaction worker without blocking.
+func (db *DB) scheduleCompaction() {
+	select {
+	case db.compactCh <- struct{}{}:
+	default:
 	}
+}
 
-	// Open it for reading
-	reader, err := OpenSSTable(path)
-	if err != nil {
-		return fmt.Errorf("db open flushed sst: %w", err)
+// compactLoop runs compactions in the background until the database
+// is closed. Compaction errors are logged and retried on the next
+// trigger; the inputs stay installed, so no data is lost.
+func (db *DB) compactLoop() {
+	defer db.bgWG.Done()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-db.compactCh:
+		}
+		for {
+			select {
+			case <-db.bgStop:
+				return
+			default:
+			}
+			compacted, err := db.maybeCompact()
+			if err != nil {
+				if err != errCompactionCanceled {
+					db.opts.Logger.Printf("background compaction: %v", err)
+				}
+				break
+			}
+			if !compacted {
+				break
+			}
+		}
 	}
+}
 
-	// Prepend to the list (newest first)
-	db.sstables = append([]*SSTableReader{reader}, db.sstables...)
-	db.nextSeq++
+// errCompactionCanceled is returned when Close interrupts a compaction.
+var errCompactionCanceled = fmt.Errorf("compaction canceled")
+
+// pickCompaction asks the strategy for the next compaction. Called
+// with db.mu held.
+func (db *DB) pickCompaction() *compaction {
+	return db.opts.CompactionStrategy.pick(db)
+}
+
+// maybeCompact runs one compaction if the strategy asks for one,
+// and reports whether it did.
+//
+// The merge runs without db.mu held, so reads keep using the old
+// tables until the outputs are installed in a single swap. Flushes
+// that land meanwhile only prepend newer level-0 tables, which are
+// left alone.
+func (db *DB) maybeCompact() (bool, error) {
+	db.mu.Lock()
+	c := db.pickCompaction()
+	if c == nil {
+		db.mu.Unlock()
+		return false, nil
+	}
+	oldest := db.oldestSnapshot()
+	db.mu.Unlock()
 
-	// Reset memtable and WAL
-	db.mem = NewMemtable(DefaultMemtableSize)
-	db.wal.Close()
-	os.Remove(filepath.Join(db.dir, "wal"))
-	wal, err := OpenWAL(filepath.Join(db.dir, "wal"))
+	// Strategies list inputs newest first, which is the order
+	// kWayMerge needs for the newest version to win. Only this
+	// goroutine removes tables, so the inputs stay installed while
+	// their readers are opened.
+	readers, err := db.openTables(c.inputs)
 	if err != nil {
-		return fmt.Errorf("db reset wal: %w", err)
+		return false, fmt.Errorf("compaction: %w", err)
+	}
+	release := func() {
+		for _, r := range readers {
+			r.Close()
+		}
 	}
-	db.wal = wal
 
-	return db.maybeCompact()
+	var targetSize int64
+	if c.split {
+		targetSize = db.opts.TargetFileSize
+	}
+	entries, rangeDels, err := mergeTables(readers, oldest, db.now(), db.opts.MergeOperator, c.dropTombstones)
+	if err != nil {
+		release()
+		return false, fmt.Errorf("compaction: %w", err)
+	}
+	outputs, err := db.writeTables(c.outputLevel, entries, rangeDels, targetSize)
+	if err != nil {
+		release()
+		return false, fmt.Errorf("compaction: %w", err)
+	}
+
+	select {
+	case <-db.bgStop:
+		// Close is waiting on us; drop the work rather than swap
+		// tables underneath it.
+		db.discardTables(outputs)
+		release()
+		return false, errCompactionCanceled
+	default:
+	}
+	if err := db.manifest.logEdit(&versionEdit{added: outputs, deleted: c.inputs}); err != nil {
+		// The edit may have reached disk, so leave the outputs for the
+		// next Open to keep or collect.
+		for _, t := range outputs {
+			db.tables.evict(t.seq)
+		}
+		release()
+		return false, fmt.Errorf("compaction: %w", err)
+	}
+
+	db.mu.Lock()
+	for level := range db.levels {
+		db.levels[level] = removeTables(db.levels[level], c.inputs)
+	}
+	db.levels[c.outputLevel] = append(db.levels[c.outputLevel], outputs...)
+	db.sortLevel(c.outputLevel)
+	if c.level > 0 {
+		db.compactPointer[c.level] = c.inputs[0].largest
+	}
+	db.mu.Unlock()
+	db.compactions.Add(1)
+
+	// Drop the cache's references and ours. Iterators still holding
+	// an input keep it open until they close.
+	for _, t := range c.inputs {
+		db.tables.evict(t.seq)
+	}
+	release()
+	db.deleteObsolete(c.inputs)
+	return true, nil
 }
 
-// maybeCompact triggers compaction when level-0 has too many SSTables.
-// We compact ALL SSTables (L0 + L1) into a single new file. This is
-// simple and makes tombstone removal safe: there are no older files
-// that could still hold a deleted key.
-func (db *DB) maybeCompact() error {
-	level0 := db.level0SSTables()
-	if len(level0) < CompactionThreshold {
-		return nil
+// writeTables writes sorted entries and range tombstones as SSTables
+// of about targetSize bytes each at the given level, and adds them to
+// the table cache. A targetSize of 0 writes a single table.
+func (db *DB) writeTables(level int, entries []SSTableEntry, rangeDels []rangeTombstone, targetSize int64) ([]*tableMeta, error) {
+	var outputs []*tableMeta
+	for _, run := range splitEntries(entries, rangeDels, targetSize) {
+		db.mu.Lock()
+		seq := db.nextSeq
+		db.nextSeq++
+		db.mu.Unlock()
+
+		path := db.sstPath(level, seq)
+		if err := writeSSTable(path, run.entries, run.rangeDels, db.opts.tableOptions(level)); err != nil {
+			os.Remove(path)
+			db.discardTables(outputs)
+			return nil, err
+		}
+		r, err := db.openTable(path, seq)
+		if err != nil {
+			os.Remove(path)
+			db.discardTables(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, newTableMeta(level, seq, r))
+		db.tables.insert(seq, r)
 	}
+	return outputs, nil
+}
 
-	// Collect paths for ALL existing SSTables, newest first by sequence.
-	// kWayMerge treats the lowest index as newest, so this ordering
-	// ensures the most recent write wins when duplicate keys exist.
-	allPaths := db.allSSTables()
+// discardTables closes and deletes tables that were never installed.
+func (db *DB) discardTables(tables []*tableMeta) {
+	for _, t := range tables {
+		db.tables.evict(t.seq)
+		os.Remove(t.path)
+	}
+}
 
-	readers := make([]*SSTableReader, 0, len(allPaths))
-	for _, path := range allPaths {
-		r, err := OpenSSTable(path)
+// openTables returns referenced readers for tables, in order, from
+// the table cache. The caller closes each one when done.
+func (db *DB) openTables(tables []*tableMeta) ([]*SSTableReader, error) {
+	readers := make([]*SSTableReader, 0, len(tables))
+	for _, t := range tables {
+		r, err := db.tables.get(t)
 		if err != nil {
-			for _, opened := range readers {
-				opened.Close()
+			for _, r := range readers {
+				r.Close()
 			}
-			return fmt.Errorf("compaction open: %w", err)
+			return nil, err
 		}
 		readers = append(readers, r)
 	}
+	return readers, nil
+}
 
-	// Merge everything into one output SSTable
-	outputPath := db.sstPath(1, db.nextSeq)
-	if err := Compact(readers, outputPath); err != nil {
-		for _, r := range readers {
-			r.Close()
+// deleteObsolete removes the files of tables that the MANIFEST no
+// longer lists, or leaves a pinned one for its last iterator to
+// remove. A crash part way through leaves files that the next Open
+// collects.
+func (db *DB) deleteObsolete(tables []*tableMeta) {
+	for _, t := range tables {
+		t.obsolete.Store(true)
+		if t.pins.Load() == 0 {
+			os.Remove(t.path)
 		}
-		return fmt.Errorf("compaction: %w", err)
 	}
-	for _, r := range readers {
-		r.Close()
+}
+
+// unpinTable releases an iterator's pin on t, removing the file if t
+// is obsolete and this was the last pin. The table may have been
+// cached again since compaction evicted it, so it is evicted once
+// more.
+func (db *DB) unpinTable(t *tableMeta) {
+	if t.pins.Add(-1) == 0 && t.obsolete.Load() {
+		db.tables.evict(t.seq)
+		os.Remove(t.path)
 	}
+}
 
-	// Close existing readers and remove ALL old SSTable files
-	for _, sst := range db.sstables {
-		sst.Close()
+// parseSSTName extracts the level and sequence number from an
+// SSTable file name of the form LEVEL-SEQ.sst.
+func parseSSTName(name string) (level, seq int, ok bool) {
+	if !strings.HasSuffix(name, ".sst") {
+		return 0, 0, false
 	}
-	for _, path := range allPaths {
-		os.Remove(path)
+	parts := strings.Split(strings.TrimSuffix(name, ".sst"), "-")
+	if len(parts) != 2 {
+		return 0, 0, false
 	}
-	db.nextSeq++
-
-	// Reload from disk (just the one new file)
-	db.sstables = nil
-	return db.loadSSTables()
+	level, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return level, seq, true
 }
 
-// level0SSTables returns paths of all level-0 SSTable files.
-func (db *DB) level0SSTables() []string {
-	entries, _ := os.ReadDir(db.dir)
-	var paths []string
-	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), "0-") && strings.HasSuffix(e.Name(), ".sst") {
-			paths = append(paths, filepath.Join(db.dir, e.Name()))
+// loadSSTables rebuilds the levels from the MANIFEST, or from the
+// directory listing if there is none yet, and then starts a new
+// MANIFEST from the recovered state.
+func (db *DB) loadSSTables() error {
+	state, found, torn, err := readManifest(db.dir, db.opts.MaxWALRecordSize)
+	if err != nil {
+		return err
+	}
+	if found {
+		db.nextSeq = state.nextSeq
+		db.minLogNum = state.logNum
+		db.lastSeqNum.Store(state.lastSeqNum)
+		for _, t := range state.added {
+			if t.level >= len(db.levels) {
+				return fmt.Errorf("sstable %d is at level %d but NumLevels is %d", t.seq, t.level, len(db.levels))
+			}
+			t.path = db.sstPath(t.level, t.seq)
+			// The table is opened when first read, but a missing
+			// file is caught now. The MANIFEST only lists tables
+			// that were complete before it was written, so this is
+			// real damage.
+			if _, err := os.Stat(t.path); err != nil {
+				return fmt.Errorf("open sstable listed in manifest: %w", err)
+			}
+			db.levels[t.level] = append(db.levels[t.level], t)
 		}
+	} else if err := db.scanSSTables(); err != nil {
+		return err
 	}
-	return paths
-}
+	for level := range db.levels {
+		db.sortLevel(level)
+	}
+
+	seq := db.nextSeq
+	db.nextSeq++
+	m, err := createManifest(db.dir, seq, db.snapshotEdit(), db.opts)
+	if err != nil {
+		return err
+	}
+	db.manifest = m
 
-// allSSTables returns paths of ALL .sst files sorted newest-first
-// by sequence number. This ordering is critical: kWayMerge treats
-// the lowest index as newest, so the most recent write wins.
-func (db *DB) allSSTables() []string {
-	entries, _ := os.ReadDir(db.dir)
+	for level := range db.levels {
+		if db.opts.CompactionStrategy.disjoint(level) {
+			if err := db.repairLevel(level); err != nil {
+				return err
+			}
+		}
+	}
+	// Unlisted files are only deleted after a clean replay: a
+	// MANIFEST that ends in damage may be missing more than its last
+	// edit.
+	if torn {
+		db.opts.Logger.Printf("MANIFEST ends in a torn record; keeping unreferenced files")
+	} else {
+		db.removeObsoleteFiles()
+	}
+	return nil
+}
 
-	type sstInfo struct {
-		path string
-		seq  int
+// scanSSTables finds tables by listing the directory and parsing
+// their names. It is only used for directories without a MANIFEST.
+func (db *DB) scanSSTables() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
 	}
-	var ssts []sstInfo
+
 	for _, e := range entries {
-		if !strings.HasSuffix(e.Name(), ".sst") {
+		level, seq, ok := parseSSTName(e.Name())
+		if !ok {
 			continue
 		}
-		parts := strings.Split(strings.TrimSuffix(e.Name(), ".sst"), "-")
-		if len(parts) != 2 {
-			continue
+		path := filepath.Join(db.dir, e.Name())
+		if level >= len(db.levels) {
+			return fmt.Errorf("sstable %s is at level %d but NumLevels is %d", path, level, len(db.levels))
+		}
+		if seq >= db.nextSeq {
+			db.nextSeq = seq + 1
 		}
-		seq, err := strconv.Atoi(parts[1])
+
+		reader, err := db.openTable(path, seq)
 		if err != nil {
+			// Tables written before renames were atomic may be torn
+			// by a crash mid-flush — remove it. The WAL still has
+			// the data and will be replayed.
+			db.opts.Logger.Printf("skipping corrupt SSTable %s: %v", path, err)
+			os.Remove(path)
 			continue
 		}
-		ssts = append(ssts, sstInfo{
-			path: filepath.Join(db.dir, e.Name()),
-			seq:  seq,
-		})
+		db.levels[level] = append(db.levels[level], newTableMeta(level, seq, reader))
+		db.tables.insert(seq, reader)
 	}
+	return nil
+}
 
-	// Newest first
-	sort.Slice(ssts, func(i, j int) bool {
-		return ssts[i].seq > ssts[j].seq
-	})
-
-	paths := make([]string, len(ssts))
-	for i, s := range ssts {
-		paths[i] = s.path
+// snapshotEdit returns an edit that recreates the current levels
+// from nothing. Called with db.mu held or before the DB is shared.
+func (db *DB) snapshotEdit() *versionEdit {
+	e := &versionEdit{nextSeq: db.nextSeq, logNum: db.minLogNum, lastSeqNum: db.lastSeqNum.Load()}
+	for _, tables := range db.levels {
+		e.added = append(e.added, tables...)
 	}
-	return paths
+	return e
 }
 
-// loadSSTables scans the directory for .sst files and opens them,
-// sorted newest-first by sequence number.
-func (db *DB) loadSSTables() error {
+// removeObsoleteFiles deletes SSTables the MANIFEST does not list,
+// MANIFESTs other than the current one, and temporary files left by
+// a write that never finished. Called during Open, before any
+// background work starts.
+func (db *DB) removeObsoleteFiles() {
+	live := make(map[int]bool)
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			live[t.seq] = true
+		}
+	}
 	entries, err := os.ReadDir(db.dir)
 	if err != nil {
-		return err
+		return
 	}
-
-	type sstInfo struct {
-		path string
-		seq  int
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(db.dir, name)
+		if _, seq, ok := parseSSTName(name); ok && !live[seq] {
+			db.opts.Logger.Printf("removing unreferenced SSTable %s", path)
+			os.Remove(path)
+		} else if strings.HasPrefix(name, "MANIFEST-") && name != db.manifest.name {
+			os.Remove(path)
+		} else if strings.HasSuffix(name, tmpSuffix) {
+			os.Remove(path)
+		}
 	}
+}
 
-	var ssts []sstInfo
-	for _, e := range entries {
-		if !strings.HasSuffix(e.Name(), ".sst") {
-			continue
+// repairLevel restores the non-overlapping invariant of a disjoint
+// level after switching from a strategy that lets the level overlap,
+// or in a directory from before the MANIFEST where a crash in the
+// middle of a compaction left both inputs and outputs. Each group
+// of overlapping tables is merged, newest first, into one table at
+// the same level. Called during Open with the level sorted by key.
+func (db *DB) repairLevel(level int) error {
+	tables := db.levels[level]
+	var repaired []*tableMeta
+	for i := 0; i < len(tables); {
+		j := i + 1
+		largest := tables[i].largest
+		for j < len(tables) && tables[j].smallest <= largest {
+			if tables[j].largest > largest {
+				largest = tables[j].largest
+			}
+			j++
 		}
-		parts := strings.Split(strings.TrimSuffix(e.Name(), ".sst"), "-")
-		if len(parts) != 2 {
+		group := tables[i:j]
+		i = j
+		if len(group) == 1 {
+			repaired = append(repaired, group[0])
 			continue
 		}
-		seq, err := strconv.Atoi(parts[1])
+
+		db.opts.Logger.Printf("repairing %d overlapping SSTables at level %d", len(group), level)
+		byAge := append([]*tableMeta(nil), group...)
+		sortBySeq(byAge)
+		readers, err := db.openTables(byAge)
 		if err != nil {
-			continue
+			return fmt.Errorf("repair level %d: %w", level, err)
 		}
-		ssts = append(ssts, sstInfo{
-			path: filepath.Join(db.dir, e.Name()),
-			seq:  seq,
-		})
-		if seq >= db.nextSeq {
-			db.nextSeq = seq + 1
+		entries, rangeDels, err := mergeTables(readers, db.oldestSnapshot(), db.now(), db.opts.MergeOperator, false)
+		for _, r := range readers {
+			r.Close()
 		}
-	}
-
-	// Sort newest first
-	sort.Slice(ssts, func(i, j int) bool {
-		return ssts[i].seq > ssts[j].seq
-	})
-
-	for _, info := range ssts {
-		reader, err := OpenSSTable(info.path)
 		if err != nil {
-			// Incomplete SSTable from a crash mid-flush — remove it.
-			// The WAL still has the data and will be replayed.
-			log.Printf("skipping corrupt SSTable %s: %v", info.path, err)
-			os.Remove(info.path)
-			continue
+			return fmt.Errorf("repair level %d: %w", level, err)
+		}
+		outputs, err := db.writeTables(level, entries, rangeDels, db.opts.TargetFileSize)
+		if err != nil {
+			return fmt.Errorf("repair level %d: %w", level, err)
+		}
+		if err := db.manifest.logEdit(&versionEdit{added: outputs, deleted: group}); err != nil {
+			return fmt.Errorf("repair level %d: %w", level, err)
 		}
-		db.sstables = append(db.sstables, reader)
+		// The merged output covers the whole group, so it can be one
+		// run even if writeTables split it into several files.
+		repaired = append(repaired, outputs...)
+		for _, t := range byAge {
+			db.tables.evict(t.seq)
+		}
+		db.deleteObsolete(byAge)
 	}
+	db.levels[level] = repaired
 	return nil
 }
 
+// openTable opens an SSTable whose data blocks go through the
+// database's block cache.
+func (db *DB) openTable(path string, seq int) (*SSTableReader, error) {
+	r, err := OpenSSTable(path)
+	if err != nil {
+		return nil, err
+	}
+	r.cache = db.blockCache
+	r.cacheKey = blockCacheKey{ns: db.cacheNS, file: uint64(seq)}
+	return r, nil
+}
+
 // sstPath returns the file path for an SSTable.
 func (db *DB) sstPath(level, seq int) string {
 	return filepath.Join(db.dir, fmt.Sprintf("%d-%06d.sst", level, seq))
 }
+
+// syncLoop fsyncs the WAL every SyncInterval until the database is
+// closed. It only runs under SyncInterval mode.
+func (db *DB) syncLoop() {
+	defer db.bgWG.Done()
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			// Close holds the leader token while it waits for us, so
+			// give up on the token if we're asked to stop.
+			select {
+			case db.commits.leader <- struct{}{}:
+			case <-db.bgStop:
+				return
+			}
+			err := db.wal.Sync()
+			<-db.commits.leader
+			if err != nil {
+				db.opts.Logger.Printf("background wal sync: %v", err)
+			}
+		}
+	}
+}
+
+// stopBackground stops background goroutines and waits for them to
+// exit. It is safe to call more than once.
+func (db *DB) stopBackground() {
+	db.stopOnce.Do(func() { close(db.bgStop) })
+	db.bgWG.Wait()
+}
@@ -1,10 +1,21 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // --- Basic DB operations ---
@@ -287,6 +298,327 @@ func TestSSTableRoundtrip(t *testing.T) {
 	}
 }
 
+func TestSSTableBlocks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocks.sst")
+
+	var entries []SSTableEntry
+	for i := 0; i < 2000; i++ {
+		// Shared prefixes exercise prefix compression and restarts.
+		entries = append(entries, SSTableEntry{
+			Key:       fmt.Sprintf("user:%06d", i*2),
+			Value:     []byte(fmt.Sprintf("value-%d", i)),
+			Tombstone: i%10 == 0,
+		})
+	}
+	opts := defaultTableOptions()
+	opts.blockSize = 512
+	if err := writeSSTable(path, entries, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.blocks) < 10 || len(r.blocks) > len(entries)/10 {
+		t.Fatalf("expected one index entry per block, got %d for %d keys", len(r.blocks), len(entries))
+	}
+	if r.smallest != "user:000000" || r.largest != "user:003998" {
+		t.Fatalf("key range: got [%s, %s]", r.smallest, r.largest)
+	}
+	for i, e := range entries {
+		val, tomb, found := r.Get(e.Key)
+		if !found || tomb != e.Tombstone || string(val) != string(e.Value) {
+			t.Fatalf("entry %d %s: got val=%q tomb=%v found=%v", i, e.Key, val, tomb, found)
+		}
+		if _, _, found := r.Get(fmt.Sprintf("user:%06d", i*2+1)); found {
+			t.Fatalf("user:%06d should not be found", i*2+1)
+		}
+	}
+
+	all, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(entries) {
+		t.Fatalf("ReadAll: expected %d entries, got %d", len(entries), len(all))
+	}
+	for i := range all {
+		if all[i].Key != entries[i].Key || all[i].Tombstone != entries[i].Tombstone {
+			t.Fatalf("ReadAll entry %d: got %+v", i, all[i])
+		}
+	}
+
+	// Seeking between keys lands on the next one, across block edges.
+	it := newSSTableIterator(r, true)
+	for i := 0; i < len(entries)-1; i += 37 {
+		it.seek(fmt.Sprintf("user:%06d", i*2+1))
+		if !it.valid() || it.entry().Key != entries[i+1].Key {
+			t.Fatalf("seek after %s: got %+v", entries[i].Key, it.entry())
+		}
+	}
+	it.seek("zzz")
+	if it.valid() {
+		t.Fatal("seek past the last key should be exhausted")
+	}
+}
+
+// writeSSTableV1 writes entries in the original per-key-index
+// format, to check that old files stay readable.
+func writeSSTableV1(t *testing.T, path string, entries []SSTableEntry) {
+	t.Helper()
+	var data, index []byte
+	for _, e := range entries {
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(e.Key)))
+		index = append(index, e.Key...)
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(e.Key)))
+		data = append(data, e.Key...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(e.Value)))
+		data = append(data, e.Value...)
+		if e.Tombstone {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+	}
+	bloom := NewBloomFilter(len(entries), DefaultBloomFPRate)
+	for _, e := range entries {
+		bloom.Add([]byte(e.Key))
+	}
+	bloomBytes := bloom.Serialize()
+
+	buf := append(data, index...)
+	buf = append(buf, bloomBytes...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(data)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entries)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(data)+len(index)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(bloomBytes)))
+	buf = binary.LittleEndian.AppendUint32(buf, sstMagicV1)
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTableV1Compat(t *testing.T) {
+	dir := t.TempDir()
+	var entries []SSTableEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, SSTableEntry{
+			Key:       fmt.Sprintf("key-%03d", i),
+			Value:     []byte(fmt.Sprintf("old-%03d", i)),
+			Tombstone: i == 50,
+		})
+	}
+	// A directory from before the MANIFEST, holding one v1 table.
+	writeSSTableV1(t, filepath.Join(dir, "0-000001.sst"), entries)
+
+	opts := &Options{CompactionStrategy: MergeAllStrategy, CompactionThreshold: 2}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("key-007"); err != nil || string(val) != "old-007" {
+		t.Fatalf("key-007 from v1 table: got %q (err=%v)", val, err)
+	}
+	if _, err := db.Get("key-050"); err != ErrKeyNotFound {
+		t.Fatalf("key-050 should be deleted, got err=%v", err)
+	}
+	it := db.NewIterator()
+	count := 0
+	for it.Seek("key-090"); it.Valid(); it.Next() {
+		count++
+	}
+	it.Close()
+	if count != 10 {
+		t.Fatalf("expected 10 keys from key-090, got %d", count)
+	}
+
+	// Compacting the v1 table rewrites its data in the v2 format.
+	db.Put("key-000", []byte("new"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for _, tables := range db2.levels {
+		for _, tm := range tables {
+			r, err := db2.tables.get(tm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.version != sstVersion {
+				t.Fatalf("table %d is still version %d", tm.seq, r.version)
+			}
+			r.Close()
+		}
+	}
+	if val, err := db2.Get("key-000"); err != nil || string(val) != "new" {
+		t.Fatalf("key-000: got %q (err=%v)", val, err)
+	}
+	if val, err := db2.Get("key-099"); err != nil || string(val) != "old-099" {
+		t.Fatalf("key-099: got %q (err=%v)", val, err)
+	}
+}
+
+// xorCompressor is a toy custom codec for testing registration.
+type xorCompressor struct{}
+
+var errRegisterXor = RegisterCompressor(xorCompressor{})
+
+func (xorCompressor) ID() byte { return 200 }
+
+func (xorCompressor) Compress(src []byte) ([]byte, error) {
+	out, err := FlateCompressor{}.Compress(src)
+	for i := range out {
+		out[i] ^= 0x5a
+	}
+	return out, err
+}
+
+func (xorCompressor) Decompress(src []byte) ([]byte, error) {
+	in := make([]byte, len(src))
+	for i := range src {
+		in[i] = src[i] ^ 0x5a
+	}
+	return FlateCompressor{}.Decompress(in)
+}
+
+// idCompressor is xorCompressor under another ID, and not registered.
+type idCompressor struct {
+	xorCompressor
+	id byte
+}
+
+func (c idCompressor) ID() byte { return c.id }
+
+func TestSSTableCompression(t *testing.T) {
+	if errRegisterXor != nil {
+		t.Fatal(errRegisterXor)
+	}
+	if err := RegisterCompressor(xorCompressor{}); err == nil {
+		t.Fatal("registering an ID twice should fail")
+	}
+	if err := RegisterCompressor(FlateCompressor{}); err == nil {
+		t.Fatal("registering a reserved ID should fail")
+	}
+
+	var entries []SSTableEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, SSTableEntry{
+			Key:   fmt.Sprintf("log:%06d", i),
+			Value: []byte(fmt.Sprintf(`{"level":"info","msg":"request served","id":%d}`, i)),
+		})
+	}
+	dir := t.TempDir()
+	sizes := make(map[string]int64)
+	for name, c := range map[string]Compressor{
+		"none":  NoCompression,
+		"flate": FlateCompressor{},
+		"zlib":  ZlibCompressor{Level: 9},
+		"xor":   xorCompressor{},
+	} {
+		path := filepath.Join(dir, name+".sst")
+		opts := defaultTableOptions()
+		opts.compressor = c
+		if err := writeSSTable(path, entries, nil, opts); err != nil {
+			t.Fatal(err)
+		}
+		r, err := OpenSSTable(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, e := range entries {
+			if val, _, found := r.Get(e.Key); !found || string(val) != string(e.Value) {
+				t.Fatalf("%s: %s: got %q found=%v", name, e.Key, val, found)
+			}
+		}
+		if all, err := r.ReadAll(); err != nil || len(all) != len(entries) {
+			t.Fatalf("%s: ReadAll returned %d entries (err=%v)", name, len(all), err)
+		}
+		sizes[name] = r.size
+		r.Close()
+	}
+	for _, name := range []string{"flate", "zlib", "xor"} {
+		if sizes[name] >= sizes["none"]/2 {
+			t.Fatalf("%s table is %d bytes, uncompressed is %d", name, sizes[name], sizes["none"])
+		}
+	}
+}
+
+func TestLevelCompression(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemtableSize:     4096,
+		Compression:      ZlibCompressor{},
+		LevelCompression: []Compressor{NoCompression},
+	}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("compressible "), 20)
+	for i := 0; i < 500; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+
+	// Level-0 blocks are stored as is, deeper ones compressed.
+	db.mu.RLock()
+	for level, tables := range db.levels {
+		for _, tm := range tables {
+			r, err := db.tables.get(tm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := make([]byte, r.blocks[0].handle.size)
+			if _, err := r.file.ReadAt(stored, r.blocks[0].handle.offset); err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+			want := zlibCompressionID
+			if level == 0 {
+				want = noCompressionID
+			}
+			if id := stored[len(stored)-1-blockTrailerSize]; id != want {
+				t.Fatalf("level %d block has compressor %d, want %d", level, id, want)
+			}
+		}
+	}
+	db.mu.RUnlock()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tables stay readable after switching codecs.
+	db2, err := OpenWithOptions(dir, &Options{Compression: FlateCompressor{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for i := 0; i < 500; i++ {
+		if val, err := db2.Get(fmt.Sprintf("key-%04d", i)); err != nil || !bytes.Equal(val, value) {
+			t.Fatalf("key-%04d: got %q (err=%v)", i, val, err)
+		}
+	}
+}
+
 // --- Compaction correctness ---
 
 func TestCompaction(t *testing.T) {
@@ -374,7 +706,7 @@ func TestL0L1Compaction(t *testing.T) {
 
 	// Ensure everything is flushed and compacted into L1.
 	if db.mem.Len() > 0 {
-		if err := db.flush(); err != nil {
+		if err := db.Flush(); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -403,7 +735,7 @@ func TestL0L1Compaction(t *testing.T) {
 
 	// Flush remaining memtable so everything is on disk.
 	if db.mem.Len() > 0 {
-		if err := db.flush(); err != nil {
+		if err := db.Flush(); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -578,3 +910,2885 @@ func TestLargeWorkload(t *testing.T) {
 	stats := db2.Stats()
 	t.Logf("Stats after 10k workload: %+v", stats)
 }
+
+// --- Iterator: ordered scan across memtable and SSTables ---
+
+func TestIterator(t *testing.T) {
+	dir := t.TempDir()
+	// Small memtable so the data spreads across several SSTables.
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		if err := db.Put(key, []byte(fmt.Sprintf("old-%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Shadow some keys with newer versions and delete others.
+	for i := 0; i < 100; i += 3 {
+		key := fmt.Sprintf("key-%04d", i)
+		if err := db.Put(key, []byte(fmt.Sprintf("new-%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 100; i += 5 {
+		if err := db.Delete(fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.Stats().NumSSTables == 0 {
+		t.Fatal("expected data to be flushed to SSTables")
+	}
+
+	var want []string
+	for i := 0; i < 100; i++ {
+		if i%5 == 1 {
+			continue
+		}
+		want = append(want, fmt.Sprintf("key-%04d", i))
+	}
+
+	it := db.NewIterator()
+	defer it.Close()
+
+	var got []string
+	for it.Seek(""); it.Valid(); it.Next() {
+		key := it.Key()
+		var n int
+		fmt.Sscanf(key, "key-%04d", &n)
+		expected := fmt.Sprintf("old-%04d", n)
+		if n%3 == 0 {
+			expected = fmt.Sprintf("new-%04d", n)
+		}
+		if string(it.Value()) != expected {
+			t.Fatalf("%s: expected %q, got %q", key, expected, it.Value())
+		}
+		got = append(got, key)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("position %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"apple", "banana", "cherry", "date"} {
+		db.Put(k, []byte(k))
+	}
+	db.Delete("cherry")
+
+	it := db.NewIterator()
+	defer it.Close()
+
+	it.Seek("b")
+	if !it.Valid() || it.Key() != "banana" {
+		t.Fatalf("Seek(b): expected banana, got %q (valid=%v)", it.Key(), it.Valid())
+	}
+
+	// cherry is deleted, so the next live key is date.
+	it.Next()
+	if !it.Valid() || it.Key() != "date" {
+		t.Fatalf("expected date after banana, got %q (valid=%v)", it.Key(), it.Valid())
+	}
+
+	it.Next()
+	if it.Valid() {
+		t.Fatalf("expected iterator to be exhausted, got %q", it.Key())
+	}
+
+	it.Seek("zzz")
+	if it.Valid() {
+		t.Fatalf("Seek past the end should be invalid, got %q", it.Key())
+	}
+}
+
+func TestIteratorSurvivesCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		db.Put(fmt.Sprintf("key-%04d", i), []byte("v"))
+	}
+
+	it := db.NewIterator()
+	defer it.Close()
+
+	// Enough writes to flush and compact away the SSTables the
+	// iterator is holding.
+	for i := 50; i < 400; i++ {
+		db.Put(fmt.Sprintf("key-%04d", i), []byte("v"))
+	}
+
+	count := 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 50 {
+		t.Fatalf("expected 50 keys from the original view, got %d", count)
+	}
+
+	// Tables compaction removed stay on disk until the iterator that
+	// pinned them closes.
+	it.Close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if n := db2.Stats().NumSSTables; len(files) != n {
+		t.Fatalf("%d SSTable files left for %d live tables", len(files), n)
+	}
+}
+
+// --- WriteBatch: atomic multi-key writes ---
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("stale", []byte("x"))
+
+	var batch WriteBatch
+	batch.Put("a", []byte("1"))
+	batch.Put("b", []byte("2"))
+	batch.Delete("stale")
+	batch.Put("a", []byte("3")) // later write in the batch wins
+	if batch.Count() != 4 {
+		t.Fatalf("expected 4 ops, got %d", batch.Count())
+	}
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := db.Get("a"); err != nil || string(val) != "3" {
+		t.Fatalf("a: expected '3', got %q (err=%v)", val, err)
+	}
+	if val, err := db.Get("b"); err != nil || string(val) != "2" {
+		t.Fatalf("b: expected '2', got %q (err=%v)", val, err)
+	}
+	if _, err := db.Get("stale"); err != ErrKeyNotFound {
+		t.Fatalf("stale should be deleted, got err=%v", err)
+	}
+
+	batch.Clear()
+	if batch.Count() != 0 {
+		t.Fatalf("expected empty batch after Clear, got %d", batch.Count())
+	}
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBatchRecovery(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+
+	wal, err := OpenWAL(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Append(WALEntry{Op: OpPut, Key: []byte("before"), Value: []byte("ok")})
+	wal.AppendBatch([]WALEntry{
+		{Op: OpPut, Key: []byte("x"), Value: []byte("1")},
+		{Op: OpDelete, Key: []byte("before")},
+	})
+	wal.Close()
+
+	entries, err := Replay(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 replayed entries, got %d", len(entries))
+	}
+	if entries[2].Op != OpDelete || string(entries[2].Key) != "before" {
+		t.Fatalf("unexpected last entry: %+v", entries[2])
+	}
+
+	// Append a second batch, then tear its last byte off to simulate
+	// a crash mid-write. None of that batch may be replayed.
+	wal, err = OpenWAL(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.AppendBatch([]WALEntry{
+		{Op: OpPut, Key: []byte("y"), Value: []byte("2")},
+		{Op: OpPut, Key: []byte("z"), Value: []byte("3")},
+	})
+	wal.Close()
+	info, _ := os.Stat(walPath)
+	if err := os.Truncate(walPath, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if val, err := db.Get("x"); err != nil || string(val) != "1" {
+		t.Fatalf("x: expected '1', got %q (err=%v)", val, err)
+	}
+	if _, err := db.Get("before"); err != ErrKeyNotFound {
+		t.Fatalf("before should be deleted by the first batch, got err=%v", err)
+	}
+	for _, k := range []string{"y", "z"} {
+		if _, err := db.Get(k); err != ErrKeyNotFound {
+			t.Fatalf("%s from the torn batch should not be visible, got err=%v", k, err)
+		}
+	}
+}
+
+// --- Concurrency: mixed readers and writers during flush/compaction ---
+// Run with -race to check the locking.
+
+func TestConcurrentReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	// Tiny memtable so flushes and compactions run constantly.
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers = 4
+	const readers = 4
+	const perWriter = 300
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	done := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d-key-%04d", w, i)
+				if err := db.Put(key, []byte(fmt.Sprintf("val-%04d", i))); err != nil {
+					errs <- err
+					return
+				}
+				if i%4 == 0 {
+					if err := db.Delete(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	var rwg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		rwg.Add(1)
+		go func(r int) {
+			defer rwg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d-key-%04d", r%writers, n%perWriter)
+				val, err := db.Get(key)
+				if err != nil && err != ErrKeyNotFound {
+					errs <- err
+					return
+				}
+				if err == nil && string(val) != fmt.Sprintf("val-%04d", n%perWriter) {
+					errs <- fmt.Errorf("%s: unexpected value %q", key, val)
+					return
+				}
+				if n%50 == 0 {
+					it := db.NewIterator()
+					prev := ""
+					for it.Seek(""); it.Valid(); it.Next() {
+						if it.Key() <= prev {
+							errs <- fmt.Errorf("iterator out of order: %q after %q", it.Key(), prev)
+							it.Close()
+							return
+						}
+						prev = it.Key()
+					}
+					it.Close()
+					db.Stats()
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	rwg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := fmt.Sprintf("w%d-key-%04d", w, i)
+			val, err := db.Get(key)
+			if i%4 == 0 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("%s should be deleted, got err=%v", key, err)
+				}
+				continue
+			}
+			if err != nil || string(val) != fmt.Sprintf("val-%04d", i) {
+				t.Fatalf("%s: got %q (err=%v)", key, val, err)
+			}
+		}
+	}
+}
+
+func TestConcurrentBatches(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each batch moves a token between two keys. Readers must never
+	// see both or neither, because a batch becomes visible with a
+	// single advance of the last sequence number.
+	db.Put("left", []byte("token"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			var b WriteBatch
+			if i%2 == 0 {
+				b.Delete("left")
+				b.Put("right", []byte("token"))
+			} else {
+				b.Delete("right")
+				b.Put("left", []byte("token"))
+			}
+			// Padding writes keep the memtable flushing.
+			b.Put(fmt.Sprintf("pad-%04d", i), []byte("xxxxxxxxxxxxxxxx"))
+			if err := db.Write(&b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		it := db.NewIterator()
+		holders := 0
+		for _, k := range []string{"left", "right"} {
+			it.Seek(k)
+			if it.Valid() && it.Key() == k {
+				holders++
+			}
+		}
+		it.Close()
+		if holders != 1 {
+			t.Fatalf("expected exactly one token holder, got %d", holders)
+		}
+	}
+	wg.Wait()
+}
+
+func TestClosedDB(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("k", []byte("v"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("k", []byte("v")); err != ErrClosed {
+		t.Fatalf("Put: expected ErrClosed, got %v", err)
+	}
+	if _, err := db.Get("k"); err != ErrClosed {
+		t.Fatalf("Get: expected ErrClosed, got %v", err)
+	}
+	if err := db.Close(); err != ErrClosed {
+		t.Fatalf("Close: expected ErrClosed, got %v", err)
+	}
+}
+
+// --- Options: validation, defaults, and plumbing ---
+
+func TestOptionsValidation(t *testing.T) {
+	bad := []*Options{
+		{MemtableSize: -1},
+		{CompactionThreshold: -1},
+		{BloomFPRate: 1.5},
+		{BloomFPRate: -0.1},
+		{MaxWALRecordSize: -1},
+		{CompactionStrategy: CompactionStrategy(99)},
+		{SyncMode: SyncMode(99)},
+		{Compression: idCompressor{id: 201}},                // unregistered
+		{Compression: idCompressor{id: 3}},                  // reserved, not built in
+		{Compression: idCompressor{id: flateCompressionID}}, // not the built-in codec
+		{Compression: idCompressor{id: 200}},                // not the registered codec
+		{LevelCompression: []Compressor{nil, idCompressor{id: 201}}},
+	}
+	for _, opts := range bad {
+		if _, err := OpenWithOptions(t.TempDir(), opts); err == nil {
+			t.Fatalf("expected error for %+v", *opts)
+		}
+	}
+
+	opts := (&Options{MemtableSize: 1024}).withDefaults()
+	if opts.MemtableSize != 1024 {
+		t.Fatalf("MemtableSize overridden: %d", opts.MemtableSize)
+	}
+	if opts.CompactionThreshold != CompactionThreshold || opts.BloomFPRate != DefaultBloomFPRate {
+		t.Fatalf("defaults not applied: %+v", opts)
+	}
+}
+
+func TestOptionsApplied(t *testing.T) {
+	dir := t.TempDir()
+	var logBuf bytes.Buffer
+	opts := &Options{
+		MemtableSize:        128,
+		CompactionThreshold: 100, // never compact in this test
+		FileMode:            0600,
+		Logger:              log.New(&logBuf, "", 0),
+	}
+
+	// A corrupt SSTable should be reported through the configured logger.
+	if err := os.WriteFile(filepath.Join(dir, "0-000001.sst"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !strings.Contains(logBuf.String(), "skipping corrupt SSTable") {
+		t.Fatalf("expected corrupt SSTable message in logger, got %q", logBuf.String())
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().NumSSTables; n < 5 {
+		t.Fatalf("expected many flushes with a 128-byte memtable, got %d SSTables", n)
+	}
+
+	info, err := os.Stat(activeWAL(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected WAL mode 0600, got %v", perm)
+	}
+}
+
+func TestWALMaxRecordSize(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), &Options{MaxWALRecordSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("small", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("big", make([]byte, 128)); err == nil {
+		t.Fatal("expected error writing a record larger than MaxWALRecordSize")
+	}
+	if _, err := db.Get("big"); err != ErrKeyNotFound {
+		t.Fatalf("rejected write should not be visible, got err=%v", err)
+	}
+}
+
+// --- Group commit: concurrent writers share a WAL write ---
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the leader token so every writer below queues up behind
+	// a "busy" leader, then release it and let one of them lead.
+	const n = 16
+	db.commits.leader <- struct{}{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Put(fmt.Sprintf("key-%02d", i), []byte("v")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for {
+		db.commits.mu.Lock()
+		queued := len(db.commits.pending)
+		db.commits.mu.Unlock()
+		if queued == n {
+			break
+		}
+		runtime.Gosched()
+	}
+	<-db.commits.leader
+	wg.Wait()
+
+	if w := db.Stats().WALWrites; w != 1 {
+		t.Fatalf("expected all %d writes in one WAL write, got %d", n, w)
+	}
+
+	// Reopen from the WAL alone: every queued write must be durable.
+	walEntries, err := Replay(activeWAL(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walEntries) != n {
+		t.Fatalf("expected %d WAL entries, got %d", n, len(walEntries))
+	}
+	db.Close()
+
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for i := 0; i < n; i++ {
+		if _, err := db2.Get(fmt.Sprintf("key-%02d", i)); err != nil {
+			t.Fatalf("key-%02d missing after reopen: %v", i, err)
+		}
+	}
+}
+
+func TestGroupCommitOrdering(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers race on the same key. Whatever the live DB ends up
+	// with must match what WAL replay produces.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				db.Put("shared", []byte(fmt.Sprintf("g%d-%d", g, i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	live, err := db.Get("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Replay(activeWAL(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if string(last.Value) != string(live) {
+		t.Fatalf("WAL order diverged from memtable: wal=%q live=%q", last.Value, live)
+	}
+	if w := db.Stats().WALWrites; w > 200 {
+		t.Fatalf("expected at most 200 WAL writes, got %d", w)
+	}
+	db.Close()
+}
+
+// --- WAL sync modes ---
+
+// activeWAL returns the path of the WAL segment the database is
+// currently writing to.
+func activeWAL(db *DB) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.logPath(db.logNum)
+}
+
+// walUnsynced reports whether the WAL has writes that haven't been
+// fsync'd, holding the commit leader token so it doesn't race with
+// writers or the background syncer.
+func walUnsynced(db *DB) bool {
+	db.commits.leader <- struct{}{}
+	defer func() { <-db.commits.leader }()
+	return db.wal.unsynced
+}
+
+func TestSyncModes(t *testing.T) {
+	// SyncNever: writes stay unsynced until SyncWAL or a Sync write.
+	db, err := OpenWithOptions(t.TempDir(), &Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", []byte("1"))
+	if !walUnsynced(db) {
+		t.Fatal("SyncNever: expected unsynced WAL after Put")
+	}
+	if err := db.SyncWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if walUnsynced(db) {
+		t.Fatal("SyncNever: SyncWAL should leave nothing unsynced")
+	}
+	db.Put("b", []byte("2"))
+	if err := db.PutWithOptions("c", []byte("3"), &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if walUnsynced(db) {
+		t.Fatal("SyncNever: a Sync write should fsync the earlier tail too")
+	}
+	db.Close()
+
+	// SyncAlways with a NoSync override.
+	db, err = OpenWithOptions(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", []byte("1"))
+	if walUnsynced(db) {
+		t.Fatal("SyncAlways: expected WAL synced after Put")
+	}
+	var batch WriteBatch
+	batch.Put("b", []byte("2"))
+	if err := db.WriteWithOptions(&batch, &WriteOptions{NoSync: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !walUnsynced(db) {
+		t.Fatal("SyncAlways: NoSync write should not fsync")
+	}
+	db.DeleteWithOptions("a", &WriteOptions{NoSync: true})
+	db.Close()
+}
+
+func TestSyncInterval(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), &Options{
+		SyncMode:     SyncInterval,
+		SyncInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for walUnsynced(db) {
+		if time.Now().After(deadline) {
+			t.Fatal("background syncer never fsync'd the WAL")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSyncOnRotate(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), &Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", []byte("1"))
+	db.commits.leader <- struct{}{}
+	rotated := db.wal
+	<-db.commits.leader
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.unsynced {
+		t.Fatal("rotated WAL was closed without an fsync")
+	}
+}
+
+func TestSyncWALClosed(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), &Options{SyncMode: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SyncWAL(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// --- Background flush: immutable memtable queue ---
+
+func TestImmutableMemtables(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{
+		MemtableSize:          128,
+		MaxImmutableMemtables: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop the flusher so full memtables pile up in the queue.
+	db.stopBackground()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprintf("val-%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete("key-0000")
+
+	stats := db.Stats()
+	if stats.NumImmutable < 5 || stats.NumSSTables != 0 {
+		t.Fatalf("expected queued immutable memtables and no SSTables, got %+v", stats)
+	}
+
+	// Reads and iterators must see data that only lives in the queue.
+	if val, err := db.Get("key-0001"); err != nil || string(val) != "val-0001" {
+		t.Fatalf("key-0001: got %q (err=%v)", val, err)
+	}
+	if _, err := db.Get("key-0000"); err != ErrKeyNotFound {
+		t.Fatalf("key-0000 should be deleted, got err=%v", err)
+	}
+	it := db.NewIterator()
+	count := 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+	}
+	it.Close()
+	if count != 99 {
+		t.Fatalf("expected 99 keys from iterator, got %d", count)
+	}
+
+	// Simulate a crash: reopen without closing. The frozen WALs must
+	// be replayed and flushed by the new instance.
+	db2, err := OpenWithOptions(dir, &Options{MemtableSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats = db2.Stats()
+	if stats.NumImmutable != 0 || stats.MemtableCount != 0 {
+		t.Fatalf("expected everything flushed, got %+v", stats)
+	}
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		if val, err := db2.Get(key); err != nil || string(val) != fmt.Sprintf("val-%04d", i) {
+			t.Fatalf("%s after recovery: got %q (err=%v)", key, val, err)
+		}
+	}
+	if _, err := db2.Get("key-0000"); err != ErrKeyNotFound {
+		t.Fatalf("key-0000 should stay deleted, got err=%v", err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 1 || segments[0] != activeWAL(db2) {
+		t.Fatalf("flushed WAL segments should be retired, found %v", segments)
+	}
+	db2.Close()
+}
+
+func TestWriteStall(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), &Options{
+		MemtableSize:          64,
+		MaxImmutableMemtables: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopBackground()
+
+	// Fill the active memtable, freeze it, and fill the next one.
+	for db.Stats().NumImmutable == 0 || !db.mem.IsFull() {
+		if err := db.Put(fmt.Sprintf("key-%04d", db.Stats().MemtableCount), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The queue is full, so this write has to wait for a flush.
+	done := make(chan error, 1)
+	go func() { done <- db.Put("stalled", []byte("v")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("write should stall while the queue is full, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := db.flushOldestImmutable(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write still stalled after the queue drained")
+	}
+	if _, err := db.Get("stalled"); err != nil {
+		t.Fatalf("stalled write not visible: %v", err)
+	}
+}
+
+// --- Background compaction ---
+
+// waitForCompaction polls until no compaction is pending.
+func waitForCompaction(t *testing.T, db *DB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.RLock()
+		pending := db.pickCompaction() != nil
+		db.mu.RUnlock()
+		if !pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("compaction never caught up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 300; i++ {
+		if err := db.Put(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprintf("val-%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 300; i += 2 {
+		db.Delete(fmt.Sprintf("key-%04d", i))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+
+	stats := db.Stats()
+	if stats.Compactions == 0 {
+		t.Fatalf("expected background compactions, got %+v", stats)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		val, err := db.Get(key)
+		if i%2 == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("%s should be deleted, got err=%v", key, err)
+			}
+		} else if err != nil || string(val) != fmt.Sprintf("val-%04d", i) {
+			t.Fatalf("%s: got %q (err=%v)", key, val, err)
+		}
+	}
+
+	// Replaced inputs must be gone from disk; only installed tables
+	// remain. The worker removes them just after the swap, so allow
+	// it a moment.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+		if len(files) == stats.NumSSTables {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d SSTable files on disk, found %d", stats.NumSSTables, len(files))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	db.Close()
+}
+
+func TestCloseDuringCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 256, CompactionThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		db.Put(fmt.Sprintf("key-%04d", i), []byte("value"))
+	}
+	// Close right away, whatever the compaction worker is doing.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for i := 0; i < 500; i++ {
+		if _, err := db2.Get(fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatalf("key-%04d lost across close: %v", i, err)
+		}
+	}
+}
+
+// --- Leveled compaction ---
+
+// checkLevels fails the test if any disjoint level is unsorted or
+// has overlapping tables.
+func checkLevels(t *testing.T, db *DB) {
+	t.Helper()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for level := 1; level < len(db.levels); level++ {
+		if !db.opts.CompactionStrategy.disjoint(level) {
+			continue
+		}
+		tables := db.levels[level]
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].largest >= tables[i].smallest {
+				t.Fatalf("level %d: %s [%s, %s] overlaps %s [%s, %s]", level,
+					tables[i-1].path, tables[i-1].smallest, tables[i-1].largest,
+					tables[i].path, tables[i].smallest, tables[i].largest)
+			}
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemtableSize:   512,
+		NumLevels:      4,
+		LevelBaseSize:  4096,
+		TargetFileSize: 1024,
+	}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write keys in a scattered order, overwrite some and delete others,
+	// so every level sees overlapping ranges and tombstones.
+	want := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key-%04d", (i*37)%500)
+			switch {
+			case round == 2 && i%5 == 0:
+				db.Delete(key)
+				delete(want, key)
+			default:
+				val := fmt.Sprintf("val-%d-%04d", round, i)
+				if err := db.Put(key, []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = val
+			}
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	checkLevels(t, db)
+
+	stats := db.Stats()
+	if len(stats.Levels) != 4 {
+		t.Fatalf("expected 4 levels in stats, got %d", len(stats.Levels))
+	}
+	deep := 0
+	for level := 1; level < len(stats.Levels); level++ {
+		deep += stats.Levels[level].Files
+	}
+	if deep < 2 {
+		t.Fatalf("expected compaction to split output into several files, got %+v", stats.Levels)
+	}
+	if stats.Levels[0].Files >= CompactionThreshold {
+		t.Fatalf("level 0 left over threshold: %+v", stats.Levels)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			val, err := db.Get(key)
+			if w, ok := want[key]; ok {
+				if err != nil || string(val) != w {
+					t.Fatalf("%s: got %q (err=%v), want %q", key, val, err, w)
+				}
+			} else if err != ErrKeyNotFound {
+				t.Fatalf("%s should be deleted, got %q (err=%v)", key, val, err)
+			}
+		}
+		it := db.NewIterator()
+		defer it.Close()
+		n := 0
+		for it.Seek(""); it.Valid(); it.Next() {
+			if string(it.Value()) != want[it.Key()] {
+				t.Fatalf("iterator %s: got %q, want %q", it.Key(), it.Value(), want[it.Key()])
+			}
+			n++
+		}
+		if n != len(want) {
+			t.Fatalf("iterator returned %d keys, want %d", n, len(want))
+		}
+	}
+	check(db)
+	db.Close()
+
+	// Levels are recovered from the file names.
+	db2, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	checkLevels(t, db2)
+	check(db2)
+}
+
+func TestLevelRepairOnOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	// Simulate a crash mid-compaction: an output table at level 1
+	// overlaps an older input that was never deleted.
+	older := []SSTableEntry{
+		{Key: "a", Value: []byte("old")},
+		{Key: "b", Value: []byte("old")},
+		{Key: "c", Value: []byte("old")},
+	}
+	newer := []SSTableEntry{
+		{Key: "b", Value: []byte("new")},
+		{Key: "c", Tombstone: true},
+		{Key: "d", Value: []byte("new")},
+	}
+	if err := WriteSSTable(filepath.Join(dir, "1-000001.sst"), older); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSSTable(filepath.Join(dir, "1-000002.sst"), newer); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkLevels(t, db)
+
+	for key, want := range map[string]string{"a": "old", "b": "new", "d": "new"} {
+		val, err := db.Get(key)
+		if err != nil || string(val) != want {
+			t.Fatalf("%s: got %q (err=%v), want %q", key, val, err, want)
+		}
+	}
+	if _, err := db.Get("c"); err != ErrKeyNotFound {
+		t.Fatalf("c should stay deleted, got err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1-000001.sst")); !os.IsNotExist(err) {
+		t.Fatalf("overlapping input should be removed, stat err=%v", err)
+	}
+}
+
+// --- Compaction strategies ---
+
+func TestCompactionStrategies(t *testing.T) {
+	strategies := map[string]CompactionStrategy{
+		"leveled":     LeveledStrategy,
+		"size-tiered": SizeTieredStrategy,
+		"merge-all":   MergeAllStrategy,
+	}
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &Options{
+				MemtableSize:       512,
+				CompactionStrategy: strategy,
+				NumLevels:          4,
+				LevelBaseSize:      4096,
+				TargetFileSize:     1024,
+			}
+			db, err := OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]string)
+			for round := 0; round < 4; round++ {
+				for i := 0; i < 400; i++ {
+					key := fmt.Sprintf("key-%04d", (i*37)%400)
+					if round == 3 && i%3 == 0 {
+						db.Delete(key)
+						delete(want, key)
+						continue
+					}
+					val := fmt.Sprintf("val-%d-%04d", round, i)
+					if err := db.Put(key, []byte(val)); err != nil {
+						t.Fatal(err)
+					}
+					want[key] = val
+				}
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			waitForCompaction(t, db)
+			checkLevels(t, db)
+
+			stats := db.Stats()
+			if stats.Compactions == 0 {
+				t.Fatalf("expected compactions, got %+v", stats)
+			}
+			switch strategy {
+			case SizeTieredStrategy:
+				for level, ls := range stats.Levels {
+					if ls.Files >= CompactionThreshold {
+						t.Fatalf("level %d has %d runs, want fewer than %d", level, ls.Files, CompactionThreshold)
+					}
+				}
+			case MergeAllStrategy:
+				for level := 2; level < len(stats.Levels); level++ {
+					if stats.Levels[level].Files != 0 {
+						t.Fatalf("merge-all left tables below level 1: %+v", stats.Levels)
+					}
+				}
+			}
+
+			check := func(db *DB) {
+				t.Helper()
+				for i := 0; i < 400; i++ {
+					key := fmt.Sprintf("key-%04d", i)
+					val, err := db.Get(key)
+					if w, ok := want[key]; ok {
+						if err != nil || string(val) != w {
+							t.Fatalf("%s: got %q (err=%v), want %q", key, val, err, w)
+						}
+					} else if err != ErrKeyNotFound {
+						t.Fatalf("%s should be deleted, got %q (err=%v)", key, val, err)
+					}
+				}
+			}
+			check(db)
+			db.Close()
+
+			db2, err := OpenWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db2.Close()
+			check(db2)
+		})
+	}
+}
+
+func TestSwitchCompactionStrategy(t *testing.T) {
+	dir := t.TempDir()
+	tiered := &Options{CompactionStrategy: SizeTieredStrategy, CompactionThreshold: 3}
+	db, err := OpenWithOptions(dir, tiered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Eight flushed runs settle as two runs in each of levels 0 and 1.
+	for round := 0; round < 8; round++ {
+		for i := 0; i < 200; i++ {
+			db.Put(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprintf("val-%d", round)))
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompaction(t, db)
+	if files := db.Stats().Levels[1].Files; files != 2 {
+		t.Fatalf("expected 2 runs in level 1, got %d", files)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping tiered runs in levels 1+ must be repaired into
+	// disjoint tables when the leveled strategy takes over.
+	var logBuf bytes.Buffer
+	db2, err := OpenWithOptions(dir, &Options{Logger: log.New(&logBuf, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if !strings.Contains(logBuf.String(), "repairing") {
+		t.Fatalf("expected overlapping runs to be repaired, log: %q", logBuf.String())
+	}
+	checkLevels(t, db2)
+	for i := 0; i < 200; i++ {
+		val, err := db2.Get(fmt.Sprintf("key-%04d", i))
+		if err != nil || string(val) != "val-7" {
+			t.Fatalf("key-%04d: got %q (err=%v)", i, val, err)
+		}
+	}
+}
+
+// --- MANIFEST ---
+
+// currentManifest returns the path of the MANIFEST named by CURRENT.
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "CURRENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, strings.TrimSpace(string(data)))
+}
+
+func TestManifestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemtableSize: 512, LevelBaseSize: 4096, TargetFileSize: 1024}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put(fmt.Sprintf("key-%04d", (i*37)%1000), []byte(fmt.Sprintf("val-%04d", i)))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	before := db.Stats().Levels
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(currentManifest(t, dir)); err != nil {
+		t.Fatalf("CURRENT does not name a MANIFEST: %v", err)
+	}
+
+	db2, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	after := db2.Stats().Levels
+	for level := range before {
+		if before[level] != after[level] {
+			t.Fatalf("level %d changed across reopen: %+v -> %+v", level, before[level], after[level])
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := db2.Get(fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatalf("key-%04d lost: %v", i, err)
+		}
+	}
+
+	// Reopening starts a new MANIFEST and removes the old one.
+	manifests, _ := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	if len(manifests) != 1 || manifests[0] != currentManifest(t, dir) {
+		t.Fatalf("expected only the current MANIFEST, found %v", manifests)
+	}
+}
+
+func TestManifestIgnoresStrayFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("real", []byte("value"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A complete table and a half-written one, neither in the MANIFEST.
+	stray := filepath.Join(dir, "0-000900.sst")
+	if err := WriteSSTable(stray, []SSTableEntry{{Key: "ghost", Value: []byte("boo")}}); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, "1-000901.sst")
+	if err := os.WriteFile(partial, []byte("half written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := OpenWithOptions(dir, &Options{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("stray files should not break Open: %v", err)
+	}
+	defer db2.Close()
+	if _, err := db2.Get("ghost"); err != ErrKeyNotFound {
+		t.Fatalf("unlisted SSTable was read: err=%v", err)
+	}
+	if val, err := db2.Get("real"); err != nil || string(val) != "value" {
+		t.Fatalf("real: got %q (err=%v)", val, err)
+	}
+	for _, path := range []string{stray, partial} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been garbage-collected", path)
+		}
+	}
+}
+
+func TestManifestMissingTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key", []byte("value"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 SSTable, found %v", files)
+	}
+	os.Remove(files[0])
+	if db, err := Open(dir); err == nil {
+		db.Close()
+		t.Fatal("Open should fail when a listed SSTable is missing")
+	}
+}
+
+func TestManifestTornEdit(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key", []byte("value"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash mid-append leaves a partial record at the tail.
+	f, err := os.OpenFile(currentManifest(t, dir), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x40, 0, 0, 0, 1, 2})
+	f.Close()
+	stray := filepath.Join(dir, "0-000900.sst")
+	if err := WriteSSTable(stray, []SSTableEntry{{Key: "ghost", Value: []byte("boo")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := OpenWithOptions(dir, &Options{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("torn MANIFEST tail should be ignored: %v", err)
+	}
+	defer db2.Close()
+	if val, err := db2.Get("key"); err != nil || string(val) != "value" {
+		t.Fatalf("key: got %q (err=%v)", val, err)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Fatalf("unlisted SSTable removed after a torn replay: %v", err)
+	}
+}
+
+func TestManifestCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		db.Put(key, []byte("value"))
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+
+	// Damage the second record, which has more records after it.
+	path := currentManifest(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := 8 + int(binary.LittleEndian.Uint32(data))
+	data[second+8] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(dir); !errors.Is(err, ErrCorruption) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("Open: got %v, want ErrCorruption", err)
+	}
+	for _, table := range tables {
+		if _, err := os.Stat(table); err != nil {
+			t.Fatalf("SSTable removed after a failed replay: %v", err)
+		}
+	}
+}
+
+func TestSSTableTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "table.sst")
+	if err := WriteSSTable(path, []SSTableEntry{{Key: "a", Value: []byte("1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("WriteSSTable left its temporary file behind")
+	}
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("real", []byte("value"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash before the rename leaves a complete-looking table under
+	// its temporary name. It was never installed, so it must not be
+	// read, and the next Open deletes it.
+	tmp := filepath.Join(dir, "0-000900.sst.tmp")
+	if err := WriteSSTable(filepath.Join(dir, "ghost.sst"), []SSTableEntry{{Key: "ghost", Value: []byte("boo")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "ghost.sst"), tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := db2.Get("ghost"); err != ErrKeyNotFound {
+		t.Fatalf("temporary SSTable was read: err=%v", err)
+	}
+	if val, err := db2.Get("real"); err != nil || string(val) != "value" {
+		t.Fatalf("real: got %q (err=%v)", val, err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("leftover temporary file should have been removed")
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 128, MaxImmutableMemtables: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep every memtable queued so each one's segment stays live.
+	db.stopBackground()
+	for i := 0; i < 60; i++ {
+		if err := db.Put(fmt.Sprintf("key-%02d", i%20), []byte(fmt.Sprintf("val-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) < 3 {
+		t.Fatalf("expected a segment per memtable, found %v", segments)
+	}
+
+	// Crash and reopen: every segment is replayed, oldest first, so
+	// the last write to each key wins.
+	db2, err := OpenWithOptions(dir, &Options{MemtableSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for i := 40; i < 60; i++ {
+		key := fmt.Sprintf("key-%02d", i%20)
+		if val, err := db2.Get(key); err != nil || string(val) != fmt.Sprintf("val-%02d", i) {
+			t.Fatalf("%s after recovery: got %q (err=%v)", key, val, err)
+		}
+	}
+	if err := db2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ = filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) != 1 || segments[0] != activeWAL(db2) {
+		t.Fatalf("flushed segments should be retired, found %v", segments)
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(t.TempDir(), "archive")
+	db, err := OpenWithOptions(dir, &Options{MemtableSize: 128, WALArchiveDir: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key-%02d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(segments) != 0 {
+		t.Fatalf("flushed segments should have left the database, found %v", segments)
+	}
+	archived, _ := filepath.Glob(filepath.Join(archive, "*.log"))
+	if len(archived) < 2 {
+		t.Fatalf("expected archived segments, found %v", archived)
+	}
+	// The archive holds every write, in order.
+	var keys []string
+	for _, path := range archived {
+		entries, err := Replay(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			keys = append(keys, string(e.Key))
+		}
+	}
+	if len(keys) != 50 || keys[0] != "key-00" || keys[49] != "key-49" {
+		t.Fatalf("archive does not replay the writes in order: %v", keys)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	cache := NewBlockCache(64 * 1024)
+	opts := &Options{BlockCache: cache}
+	dbA, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbA.Close()
+	dbB, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbB.Close()
+
+	// Both databases get tables with the same file numbers; their
+	// blocks must not be confused in the shared cache.
+	for i := 0; i < 100; i++ {
+		dbA.Put(fmt.Sprintf("key-%03d", i), []byte("from-a"))
+		dbB.Put(fmt.Sprintf("key-%03d", i), []byte("from-b"))
+	}
+	if err := dbA.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := dbA.Stats().BlockCache
+	for i := 0; i < 10; i++ {
+		if val, err := dbA.Get("key-042"); err != nil || string(val) != "from-a" {
+			t.Fatalf("dbA key-042: got %q (err=%v)", val, err)
+		}
+		if val, err := dbB.Get("key-042"); err != nil || string(val) != "from-b" {
+			t.Fatalf("dbB key-042: got %q (err=%v)", val, err)
+		}
+	}
+	after := dbB.Stats().BlockCache
+	if misses := after.Misses - before.Misses; misses != 2 {
+		t.Fatalf("expected one miss per database, got %d", misses)
+	}
+	if hits := after.Hits - before.Hits; hits != 18 {
+		t.Fatalf("expected 18 hits, got %d", hits)
+	}
+	if after.Bytes == 0 {
+		t.Fatal("cache should hold the blocks read")
+	}
+
+	// Get returns a copy, so the caller can't damage the cached block.
+	val, _ := dbA.Get("key-042")
+	copy(val, "XXXXXX")
+	if val, err := dbA.Get("key-042"); err != nil || string(val) != "from-a" {
+		t.Fatalf("writing to a returned value changed the cache: got %q (err=%v)", val, err)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	c := NewBlockCache(blockCacheShards * 100)
+	// Keys that land in one shard, 40 bytes each: room for two.
+	var keys []blockCacheKey
+	for off := int64(0); len(keys) < 3; off++ {
+		k := blockCacheKey{ns: 1, file: 1, offset: off}
+		if c.shard(k) == &c.shards[0] {
+			keys = append(keys, k)
+		}
+	}
+	block := make([]byte, 40)
+	c.insert(keys[0], block)
+	c.insert(keys[1], block)
+	c.get(keys[0]) // keys[1] is now least recently used
+	c.insert(keys[2], block)
+
+	if _, ok := c.get(keys[1]); ok {
+		t.Fatal("least recently used block should have been evicted")
+	}
+	for _, k := range []blockCacheKey{keys[0], keys[2]} {
+		if _, ok := c.get(k); !ok {
+			t.Fatalf("block %+v should still be cached", k)
+		}
+	}
+	if size := c.Size(); size != 80 {
+		t.Fatalf("expected 80 cached bytes, got %d", size)
+	}
+	c.insert(blockCacheKey{offset: 99}, make([]byte, 200))
+	if size := c.Size(); size > 100*blockCacheShards {
+		t.Fatalf("cache exceeded its capacity: %d bytes", size)
+	}
+}
+
+func TestTableCache(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{CompactionThreshold: 100, MaxOpenTables: 2}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// One table per flush, each holding its own keys.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			db.Put(fmt.Sprintf("key-%d-%d", i, j), []byte(fmt.Sprintf("v%d", i)))
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := db.Stats().NumSSTables; n != 5 {
+		t.Fatalf("expected 5 sstables, got %d", n)
+	}
+
+	// An iterator can read every table, even those the cache evicts.
+	it := db.NewIterator()
+	defer it.Close()
+	for i := 0; i < 5; i++ {
+		if val, err := db.Get(fmt.Sprintf("key-%d-5", i)); err != nil || string(val) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("key-%d-5: got %q (err=%v)", i, val, err)
+		}
+		if n := db.Stats().OpenTables; n > 2 {
+			t.Fatalf("table cache holds %d readers, limit is 2", n)
+		}
+	}
+	count := 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+	}
+	if it.Err() != nil || count != 50 {
+		t.Fatalf("iterator saw %d keys (err=%v), want 50", count, it.Err())
+	}
+	it.Close()
+
+	// Tables listed in the MANIFEST are opened lazily on reopen.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := db.Stats().OpenTables; n != 0 {
+		t.Fatalf("expected no open tables after reopen, got %d", n)
+	}
+	if val, err := db.Get("key-0-0"); err != nil || string(val) != "v0" {
+		t.Fatalf("key-0-0: got %q (err=%v)", val, err)
+	}
+
+	// An iterator opens a table when it reaches the table's keys and
+	// releases it once past them.
+	it = db.NewIterator()
+	defer it.Close()
+	if n := heldTables(it); n != 0 {
+		t.Fatalf("new iterator holds %d tables open", n)
+	}
+	count = 0
+	for it.Seek("key-2"); it.Valid(); it.Next() {
+		if n := heldTables(it); n > 1 {
+			t.Fatalf("iterator holds %d tables open at %s", n, it.Key())
+		}
+		count++
+	}
+	if it.Err() != nil || count != 30 {
+		t.Fatalf("iterator saw %d keys (err=%v), want 30", count, it.Err())
+	}
+	if n := heldTables(it); n != 0 {
+		t.Fatalf("exhausted iterator holds %d tables open", n)
+	}
+}
+
+// heldTables returns the number of SSTables an iterator has open.
+func heldTables(it *Iterator) int {
+	n := 0
+	for _, src := range it.sources {
+		if ti, ok := src.(*tableIterator); ok && ti.r != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// flipByte corrupts one byte of a file in place.
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTableChecksums(t *testing.T) {
+	dir := t.TempDir()
+	var entries []SSTableEntry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, SSTableEntry{
+			Key:   fmt.Sprintf("key-%04d", i),
+			Value: []byte(fmt.Sprintf("value-%04d", i)),
+		})
+	}
+	path := filepath.Join(dir, "table.sst")
+	if err := WriteSSTable(path, entries); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.blocks) < 3 {
+		t.Fatalf("expected several data blocks, got %d", len(r.blocks))
+	}
+	second := r.blocks[1]
+	index := r.blocks[len(r.blocks)-1].handle.offset + r.blocks[len(r.blocks)-1].handle.size
+	r.Close()
+
+	// Damage to a data block surfaces when the block is read.
+	flipByte(t, path, second.handle.offset+second.handle.size/2)
+	r, err = OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := r.Lookup(second.lastKey); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get in damaged block: expected ErrCorruption, got %v", err)
+	}
+	if _, _, found, err := r.Lookup("key-0000"); err != nil || !found {
+		t.Fatalf("Get in intact block: found=%v err=%v", found, err)
+	}
+	if _, err := r.ReadAll(); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("ReadAll: expected ErrCorruption, got %v", err)
+	}
+	r.Close()
+
+	// Damage to the index is caught on open.
+	flipByte(t, path, second.handle.offset+second.handle.size/2)
+	flipByte(t, path, index+1)
+	if _, err := OpenSSTable(path); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("open with damaged index: expected ErrCorruption, got %v", err)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprintf("value-%04d", i)))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one sstable, got %v", matches)
+	}
+	r, err := OpenSSTable(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := r.blocks[1]
+	r.Close()
+	flipByte(t, matches[0], damaged.handle.offset+damaged.handle.size/2)
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ro := &ReadOptions{VerifyChecksums: true}
+	if _, err := db.GetWithOptions(damaged.lastKey, ro); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get: expected ErrCorruption, got %v", err)
+	}
+	if val, err := db.GetWithOptions("key-0000", ro); err != nil || string(val) != "value-0000" {
+		t.Fatalf("key-0000: got %q (err=%v)", val, err)
+	}
+
+	it := db.NewIteratorWithOptions(ro)
+	defer it.Close()
+	count := 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+	}
+	if !errors.Is(it.Err(), ErrCorruption) {
+		t.Fatalf("iterator: expected ErrCorruption after %d keys, got %v", count, it.Err())
+	}
+	if count >= 1000 {
+		t.Fatalf("iterator returned every key despite the damaged block")
+	}
+}
+
+// --- Memtable skiplist ---
+
+func TestSkiplist(t *testing.T) {
+	s := NewSkiplistRep()
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+	seq := uint64(0)
+	for _, i := range rng.Perm(2000) {
+		key := fmt.Sprintf("key-%05d", i)
+		seq++
+		s.Add(key, seq, []byte("v1"), KindValue, 0)
+		want[key] = "v1"
+	}
+	// Overwrites and tombstones add newer versions in front of the
+	// old ones.
+	base := seq
+	updates := 0
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("key-%05d", i)
+		seq++
+		updates++
+		if i%2 == 0 {
+			s.Add(key, seq, nil, KindTombstone, 0)
+			want[key] = ""
+		} else {
+			s.Add(key, seq, []byte("v2"), KindValue, 0)
+			want[key] = "v2"
+		}
+	}
+	if s.Len() != 2000+updates {
+		t.Fatalf("expected %d entries, got %d", 2000+updates, s.Len())
+	}
+	for key, v := range want {
+		value, _, kind, found := s.Get(key, maxSeqNum)
+		if !found || (kind == KindTombstone) != (v == "") || string(value) != v {
+			t.Fatalf("%s: got %q kind=%v found=%v, want %q", key, value, kind, found, v)
+		}
+		// The original version is still there for older readers.
+		if value, _, kind, found := s.Get(key, base); !found || kind != KindValue || string(value) != "v1" {
+			t.Fatalf("%s at seq %d: got %q kind=%v found=%v, want v1", key, base, value, kind, found)
+		}
+	}
+	if _, _, _, found := s.Get("key-99999", maxSeqNum); found {
+		t.Fatal("missing key should not be found")
+	}
+	if _, _, _, found := s.Get("key-00000", 0); found {
+		t.Fatal("no version should be visible at seq 0")
+	}
+
+	it := s.NewIterator()
+	n := 0
+	prevKey, prevSeq := "", uint64(0)
+	for it.Seek(""); it.Valid(); it.Next() {
+		if n > 0 && compareInternal(prevKey, prevSeq, it.Key(), it.Seq()) >= 0 {
+			t.Fatalf("position %d: %s@%d after %s@%d", n, it.Key(), it.Seq(), prevKey, prevSeq)
+		}
+		prevKey, prevSeq = it.Key(), it.Seq()
+		n++
+	}
+	if n != 2000+updates {
+		t.Fatalf("iterated %d entries, want %d", n, 2000+updates)
+	}
+	it.Seek("key-01000x")
+	if !it.Valid() || it.Key() != "key-01001" {
+		t.Fatalf("seek landed on %q", it.Key())
+	}
+	// Seek lands on the newest version.
+	it.Seek("key-00003")
+	if !it.Valid() || it.Key() != "key-00003" || string(it.Value()) != "v2" {
+		t.Fatalf("seek landed on %q = %q", it.Key(), it.Value())
+	}
+}
+
+func TestSkiplistConcurrentReads(t *testing.T) {
+	// One writer and several lock-free readers; run with -race.
+	s := NewSkiplistRep()
+	const n = 5000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				prev := ""
+				it := s.NewIterator()
+				for it.Seek(""); it.Valid(); it.Next() {
+					if it.Key() <= prev {
+						t.Errorf("iterator out of order: %q after %q", it.Key(), prev)
+						return
+					}
+					prev = it.Key()
+				}
+				if value, _, _, found := s.Get("key-00000", maxSeqNum); found && string(value) != "v" {
+					t.Errorf("key-00000: got %q", value)
+					return
+				}
+			}
+		}()
+	}
+	for seq, i := range rand.New(rand.NewSource(2)).Perm(n) {
+		s.Add(fmt.Sprintf("key-%05d", i), uint64(seq+1), []byte("v"), KindValue, 0)
+	}
+	close(done)
+	wg.Wait()
+	if s.Len() != n {
+		t.Fatalf("expected %d keys, got %d", n, s.Len())
+	}
+}
+
+func TestMemtableArena(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%05d", i)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+
+	// Entries come out of shared chunks rather than one allocation
+	// per key, value, and node.
+	scratch := NewMemtable(DefaultMemtableSize)
+	allocs := testing.AllocsPerRun(1, func() {
+		for _, key := range keys {
+			scratch.Put(key, value)
+		}
+	})
+	if perPut := allocs / float64(len(keys)); perPut > 0.1 {
+		t.Fatalf("%.2f allocations per Put, want chunked allocation", perPut)
+	}
+
+	m := NewMemtable(DefaultMemtableSize)
+	for _, key := range keys {
+		m.Put(key, value)
+	}
+	// Size counts the skiplist's own structure, not just the data.
+	data := len(keys) * (len(keys[0]) + len(value))
+	size := m.Size()
+	if size <= data {
+		t.Fatalf("size %d does not exceed the %d bytes of keys and values", size, data)
+	}
+	// It counts whole chunks, so allow for one partly filled chunk of
+	// each kind of object.
+	if size > 2*data+3*arenaChunkSize {
+		t.Fatalf("size %d is far above the %d bytes of keys and values", size, data)
+	}
+
+	// The arena never reuses memory, so the older versions stay
+	// counted. Size grows a chunk at a time, and a value too large
+	// for a chunk is counted on its own.
+	m.Delete(keys[0])
+	m.Put(keys[1], value)
+	if m.Size() < size {
+		t.Fatalf("size %d after overwrites, was %d", m.Size(), size)
+	}
+	size = m.Size()
+	m.Put(keys[2], make([]byte, arenaChunkSize))
+	if m.Size() < size+arenaChunkSize {
+		t.Fatalf("size %d after a %d byte value, was %d", m.Size(), arenaChunkSize, size)
+	}
+	if val, found := m.Get(keys[0]); !found || val != nil {
+		t.Fatalf("%s should be deleted, got %q", keys[0], val)
+	}
+
+	// Values are copied, so the caller may reuse its buffer.
+	buf := []byte("original")
+	m.Put("copied", buf)
+	copy(buf, "changed!")
+	if val, _ := m.Get("copied"); string(val) != "original" {
+		t.Fatalf("memtable aliased the caller's buffer: %q", val)
+	}
+}
+
+// --- Snapshots ---
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{CompactionThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a", []byte("1"))
+	db.Put("b", []byte("1"))
+	snap := db.GetSnapshot()
+	db.Put("a", []byte("2"))
+	db.Delete("b")
+	db.Put("c", []byte("1"))
+
+	ro := &ReadOptions{Snapshot: snap}
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "1", "b": "1"} {
+			if val, err := db.GetWithOptions(key, ro); err != nil || string(val) != want {
+				t.Fatalf("%s: snapshot %s = %q (err=%v), want %q", stage, key, val, err, want)
+			}
+		}
+		if _, err := db.GetWithOptions("c", ro); err != ErrKeyNotFound {
+			t.Fatalf("%s: c was written after the snapshot, got err=%v", stage, err)
+		}
+		it := db.NewIteratorWithOptions(ro)
+		var got []string
+		for it.Seek(""); it.Valid(); it.Next() {
+			got = append(got, it.Key()+"="+string(it.Value()))
+		}
+		it.Close()
+		if strings.Join(got, ",") != "a=1,b=1" {
+			t.Fatalf("%s: snapshot iterator saw %v", stage, got)
+		}
+		if val, err := db.Get("a"); err != nil || string(val) != "2" {
+			t.Fatalf("%s: a = %q (err=%v), want 2", stage, val, err)
+		}
+		if _, err := db.Get("b"); err != ErrKeyNotFound {
+			t.Fatalf("%s: b should be deleted, got err=%v", stage, err)
+		}
+	}
+	check("memtable")
+
+	// The snapshot keeps its versions through flushes and compactions.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("flushed")
+	db.Put("d", []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if db.Stats().Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	check("compacted")
+
+	// Once released, compaction drops the versions it was holding.
+	snap.Release()
+	snap.Release()
+	db.Put("a", []byte("3"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("e", []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	db.mu.RLock()
+	var tables []*tableMeta
+	for _, level := range db.levels {
+		tables = append(tables, level...)
+	}
+	readers, err := db.openTables(tables)
+	db.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readers {
+		entries, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Key == "b" || (e.Key == "a" && string(e.Value) == "1") {
+				t.Fatalf("released version %s@%d survived compaction", e.Key, e.Seq)
+			}
+		}
+	}
+}
+
+func TestSequenceNumbersRecovered(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put("key", []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key", []byte("unflushed"))
+	last := db.lastSeqNum.Load()
+	if last != 11 {
+		t.Fatalf("last sequence number %d, want 11", last)
+	}
+	// Crash and reopen: the last write is only in the WAL.
+	db.stopBackground()
+
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if got := db2.lastSeqNum.Load(); got != last {
+		t.Fatalf("recovered last sequence number %d, want %d", got, last)
+	}
+	// New writes are numbered after the recovered ones, so they win
+	// once everything is flushed and merged.
+	db2.Put("key", []byte("newest"))
+	if err := db2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db3, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db3.Close()
+	if got := db3.lastSeqNum.Load(); got != last+1 {
+		t.Fatalf("last sequence number %d after reopen, want %d", got, last+1)
+	}
+	if val, err := db3.Get("key"); err != nil || string(val) != "newest" {
+		t.Fatalf("key = %q (err=%v), want newest", val, err)
+	}
+}
+
+// --- Range deletion ---
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{CompactionThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		db.Put(key, []byte("old"))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("bb", []byte("old"))
+	snap := db.GetSnapshot()
+	if err := db.DeleteRange("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("c", []byte("new"))
+	// An empty range deletes nothing.
+	if err := db.DeleteRange("e", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		scan := func(ro *ReadOptions) string {
+			it := db.NewIteratorWithOptions(ro)
+			defer it.Close()
+			var got []string
+			for it.Seek(""); it.Valid(); it.Next() {
+				got = append(got, it.Key()+"="+string(it.Value()))
+			}
+			return strings.Join(got, ",")
+		}
+		if got := scan(nil); got != "a=old,c=new,d=old,e=old" {
+			t.Fatalf("%s: iterator saw %s", stage, got)
+		}
+		for _, key := range []string{"b", "bb"} {
+			if _, err := db.Get(key); err != ErrKeyNotFound {
+				t.Fatalf("%s: %s should be deleted, got err=%v", stage, key, err)
+			}
+		}
+		if val, err := db.Get("c"); err != nil || string(val) != "new" {
+			t.Fatalf("%s: c = %q (err=%v), want new", stage, val, err)
+		}
+		// The snapshot predates the range tombstone.
+		ro := &ReadOptions{Snapshot: snap}
+		if got := scan(ro); got != "a=old,b=old,bb=old,c=old,d=old,e=old" {
+			t.Fatalf("%s: snapshot iterator saw %s", stage, got)
+		}
+		if val, err := db.GetWithOptions("bb", ro); err != nil || string(val) != "old" {
+			t.Fatalf("%s: snapshot bb = %q (err=%v), want old", stage, val, err)
+		}
+	}
+	check("memtable")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if db.Stats().Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	check("compacted")
+
+	// Once the snapshot is gone, compaction drops the covered
+	// versions. Writes after the tombstone come back after a crash.
+	snap.Release()
+	db.Put("bb", []byte("again"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("f", []byte("new"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	db.mu.RLock()
+	var tables []*tableMeta
+	for _, level := range db.levels {
+		tables = append(tables, level...)
+	}
+	readers, err := db.openTables(tables)
+	db.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readers {
+		entries, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Key == "b" || (e.Key == "c" && string(e.Value) == "old") {
+				t.Fatalf("covered version %s@%d survived compaction", e.Key, e.Seq)
+			}
+		}
+	}
+
+	db.DeleteRange("e", "g")
+	db.stopBackground()
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	it := db2.NewIterator()
+	var got []string
+	for it.Seek(""); it.Valid(); it.Next() {
+		got = append(got, it.Key()+"="+string(it.Value()))
+	}
+	it.Close()
+	if strings.Join(got, ",") != "a=old,bb=again,c=new,d=old" {
+		t.Fatalf("after recovery iterator saw %v", got)
+	}
+}
+
+func TestSSTableRangeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "range.sst")
+	entries := []SSTableEntry{
+		{Key: "a", Seq: 1, Value: []byte("1")},
+		{Key: "m", Seq: 5, Value: []byte("after")},
+		{Key: "m", Seq: 2, Value: []byte("before")},
+		{Key: "n", Seq: 2, Value: []byte("before")},
+	}
+	rangeDels := []rangeTombstone{{start: "k", end: "z", seq: 3}}
+	if err := writeSSTable(path, entries, rangeDels, defaultTableOptions()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.smallest != "a" || r.largest != "z" {
+		t.Fatalf("key range [%s, %s], want [a, z]", r.smallest, r.largest)
+	}
+	for _, tc := range []struct {
+		key     string
+		seq     uint64
+		want    string
+		deleted bool
+	}{
+		{"a", maxSeqNum, "1", false},
+		{"m", maxSeqNum, "after", false},
+		{"m", 4, "", true},
+		{"m", 2, "before", false},
+		{"n", maxSeqNum, "", true},
+		{"x", maxSeqNum, "", true},
+	} {
+		val, kind, found, err := r.get(tc.key, tc.seq, 0, true)
+		if err != nil || !found || (kind == KindTombstone) != tc.deleted || string(val) != tc.want {
+			t.Errorf("get(%s, %d) = %q, kind=%v found=%v err=%v", tc.key, tc.seq, val, kind, found, err)
+		}
+	}
+}
+
+// --- TTL ---
+
+// fakeClock is an Options.Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	opts := &Options{CompactionThreshold: 2, Clock: clock.Now}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("bad", []byte("v"), 0); err == nil {
+		t.Fatal("expected an error for a zero TTL")
+	}
+	db.PutWithTTL("session", []byte("token"), time.Minute)
+	db.Put("counter", []byte("old"))
+	db.PutWithTTL("counter", []byte("new"), 2*time.Minute)
+	db.Put("plain", []byte("forever"))
+
+	check := func(stage, want string) {
+		t.Helper()
+		it := db.NewIterator()
+		var got []string
+		for it.Seek(""); it.Valid(); it.Next() {
+			got = append(got, it.Key()+"="+string(it.Value()))
+		}
+		it.Close()
+		if strings.Join(got, ",") != want {
+			t.Fatalf("%s: iterator saw %v, want %s", stage, got, want)
+		}
+		for _, kv := range strings.Split(want, ",") {
+			key, value, _ := strings.Cut(kv, "=")
+			if val, err := db.Get(key); err != nil || string(val) != value {
+				t.Fatalf("%s: %s = %q (err=%v), want %q", stage, key, val, err, value)
+			}
+		}
+		for _, key := range []string{"session", "counter"} {
+			if !strings.Contains(want, key+"=") {
+				if _, err := db.Get(key); err != ErrKeyNotFound {
+					t.Fatalf("%s: %s should have expired, got err=%v", stage, key, err)
+				}
+			}
+		}
+	}
+	check("memtable", "counter=new,plain=forever,session=token")
+	clock.Advance(90 * time.Second)
+	check("memtable", "counter=new,plain=forever")
+
+	// An expired value hides the older one underneath it.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	check("flushed", "plain=forever")
+
+	// Compaction drops expired values.
+	db.Put("other", []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if db.Stats().Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	check("compacted", "other=1,plain=forever")
+	db.mu.RLock()
+	var tables []*tableMeta
+	for _, level := range db.levels {
+		tables = append(tables, level...)
+	}
+	readers, err := db.openTables(tables)
+	db.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readers {
+		entries, err := r.ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Key == "session" || e.Key == "counter" {
+				t.Fatalf("expired %s@%d survived compaction", e.Key, e.Seq)
+			}
+		}
+	}
+
+	// The expiry is logged with the value and survives a crash. The
+	// TTLs in a batch count from when it is written.
+	if err := db.PutWithTTLWithOptions("cached", []byte("v"), time.Hour, &WriteOptions{Sync: true}); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.PutWithTTL("batched", []byte("v"), time.Hour)
+	batch.Put("kept", []byte("v"))
+	clock.Advance(30 * time.Minute)
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	var bad WriteBatch
+	bad.Put("unwritten", []byte("v"))
+	bad.PutWithTTL("bad", []byte("v"), 0)
+	if err := db.Write(&bad); err == nil {
+		t.Fatal("expected an error for a batch with a zero TTL")
+	}
+	db.stopBackground()
+	db2, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	live := func(stage string, want ...string) {
+		t.Helper()
+		for _, key := range []string{"cached", "batched", "kept", "unwritten"} {
+			_, err := db2.Get(key)
+			if slices.Contains(want, key) != (err == nil) {
+				t.Fatalf("%s: %s: got err=%v, want live=%v", stage, key, err, slices.Contains(want, key))
+			}
+		}
+	}
+	live("recovered", "cached", "batched", "kept")
+	clock.Advance(30 * time.Minute)
+	live("after an hour", "batched", "kept")
+	clock.Advance(30 * time.Minute)
+	live("after the batch's hour", "kept")
+}
+
+// --- Merge operator ---
+
+// counterMerge adds up operands holding decimal integers.
+type counterMerge struct{}
+
+func (counterMerge) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	if existing != nil {
+		if _, err := fmt.Sscan(string(existing), &sum); err != nil {
+			return nil, err
+		}
+	}
+	for _, op := range operands {
+		var n int
+		if _, err := fmt.Sscan(string(op), &n); err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(fmt.Sprint(sum)), nil
+}
+
+func (c counterMerge) PartialMerge(key string, older, newer []byte) ([]byte, bool) {
+	sum, err := c.FullMerge(key, older, [][]byte{newer})
+	return sum, err == nil
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	if db, err := Open(dir); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := db.Merge("c", []byte("1")); err == nil {
+			t.Fatal("Merge without a MergeOperator should fail")
+		}
+		db.Close()
+	}
+
+	opts := &Options{CompactionThreshold: 2, MergeOperator: counterMerge{}}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("c", []byte("10"))
+	db.Merge("c", []byte("1"))
+	snap := db.GetSnapshot()
+	db.Merge("c", []byte("2"))
+	db.Merge("fresh", []byte("5"))
+	db.Put("gone", []byte("100"))
+	db.Delete("gone")
+	db.Merge("gone", []byte("7"))
+
+	check := func(stage string) {
+		t.Helper()
+		want := map[string]string{"c": "13", "fresh": "5", "gone": "7"}
+		for key, value := range want {
+			if val, err := db.Get(key); err != nil || string(val) != value {
+				t.Fatalf("%s: %s = %q (err=%v), want %s", stage, key, val, err, value)
+			}
+		}
+		if val, err := db.GetWithOptions("c", &ReadOptions{Snapshot: snap}); err != nil || string(val) != "11" {
+			t.Fatalf("%s: snapshot c = %q (err=%v), want 11", stage, val, err)
+		}
+		it := db.NewIterator()
+		var got []string
+		for it.Seek(""); it.Valid(); it.Next() {
+			got = append(got, it.Key()+"="+string(it.Value()))
+		}
+		it.Close()
+		if strings.Join(got, ",") != "c=13,fresh=5,gone=7" {
+			t.Fatalf("%s: iterator saw %v", stage, got)
+		}
+	}
+	check("memtable")
+
+	// Operands in the memtable combine with a base in an SSTable.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("flushed")
+	db.Merge("c", []byte("-3"))
+	db.Merge("c", []byte("3"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if db.Stats().Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	check("compacted")
+
+	// Compaction folds the operands every reader sees into a value,
+	// but keeps those newer than the snapshot.
+	versionsOf := func(key string) string {
+		t.Helper()
+		db.mu.RLock()
+		var tables []*tableMeta
+		for _, level := range db.levels {
+			tables = append(tables, level...)
+		}
+		readers, err := db.openTables(tables)
+		db.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []string
+		for _, r := range readers {
+			entries, err := r.ReadAll()
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Key == key {
+					versions = append(versions, fmt.Sprintf("%s/%v", e.Value, e.Merge))
+				}
+			}
+		}
+		return strings.Join(versions, ",")
+	}
+	if got := versionsOf("c"); got != "3/true,-3/true,2/true,11/false" {
+		t.Fatalf("versions of c after compaction: %s", got)
+	}
+	snap.Release()
+	db.Merge("c", []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge("c", []byte("-1"))
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if got := versionsOf("c"); got != "13/false" {
+		t.Fatalf("versions of c after the snapshot is released: %s", got)
+	}
+
+	// Operands are logged and replayed like any other write.
+	db.Merge("c", []byte("100"))
+	db.stopBackground()
+	db2, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if val, err := db2.Get("c"); err != nil || string(val) != "113" {
+		t.Fatalf("c = %q (err=%v) after recovery, want 113", val, err)
+	}
+}
+
+func TestMergeOperandsPartial(t *testing.T) {
+	entries := []SSTableEntry{
+		{Key: "a", Seq: 9, Value: []byte("4"), Merge: true},
+		{Key: "a", Seq: 8, Value: []byte("2"), Merge: true},
+		{Key: "a", Seq: 7, Value: []byte("1"), Merge: true},
+		{Key: "b", Seq: 6, Value: []byte("1"), Merge: true},
+		{Key: "b", Seq: 5, Value: []byte("1"), Merge: true},
+	}
+	rangeDels := newRangeDelIndex(nil, maxSeqNum)
+
+	// Without the base, operands every reader sees are combined into
+	// one operand; newer ones stay separate for the snapshot at 8.
+	got, err := mergeOperands(counterMerge{}, entries, rangeDels, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SSTableEntry{
+		{Key: "a", Seq: 9, Value: []byte("4"), Merge: true},
+		{Key: "a", Seq: 8, Value: []byte("3"), Merge: true},
+		{Key: "b", Seq: 6, Value: []byte("2"), Merge: true},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("partial merge: got %v, want %v", got, want)
+	}
+
+	// At the bottom there is no base to wait for.
+	got, err = mergeOperands(counterMerge{}, entries, rangeDels, maxSeqNum, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []SSTableEntry{
+		{Key: "a", Seq: 9, Value: []byte("7")},
+		{Key: "b", Seq: 6, Value: []byte("2")},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("full merge: got %v, want %v", got, want)
+	}
+
+	// A base that expires keeps its operands apart, combined.
+	entries = []SSTableEntry{
+		{Key: "c", Seq: 4, Value: []byte("2"), Merge: true},
+		{Key: "c", Seq: 3, Value: []byte("1"), Merge: true},
+		{Key: "c", Seq: 2, Value: []byte("10"), ExpiresAt: 100},
+	}
+	got, err = mergeOperands(counterMerge{}, entries, rangeDels, maxSeqNum, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []SSTableEntry{
+		{Key: "c", Seq: 4, Value: []byte("3"), Merge: true},
+		{Key: "c", Seq: 2, Value: []byte("10"), ExpiresAt: 100},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expiring base: got %v, want %v", got, want)
+	}
+}
+
+func TestMergeExpiringBase(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	db, err := OpenWithOptions(t.TempDir(), &Options{
+		CompactionThreshold: 2,
+		MergeOperator:       counterMerge{},
+		Clock:               clock.Now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Whether or not compaction has run, operands outlive the base
+	// they were written on once it expires.
+	db.PutWithTTL("k", []byte("10"), time.Minute)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge("k", []byte("5"))
+	if val, err := db.Get("k"); err != nil || string(val) != "15" {
+		t.Fatalf("k = %q (err=%v), want 15", val, err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompaction(t, db)
+	if db.Stats().Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	if val, err := db.Get("k"); err != nil || string(val) != "15" {
+		t.Fatalf("k = %q (err=%v) after compaction, want 15", val, err)
+	}
+	clock.Advance(2 * time.Minute)
+	if val, err := db.Get("k"); err != nil || string(val) != "5" {
+		t.Fatalf("k = %q (err=%v) after the base expired, want 5", val, err)
+	}
+}
+
+// --- Transactions ---
+
+func TestTxn(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("a", []byte("1"))
+	db.Put("b", []byte("1"))
+
+	// Reads see the transaction's own writes; the database doesn't
+	// until commit.
+	txn := db.BeginTxn()
+	if val, err := txn.Get("a"); err != nil || string(val) != "1" {
+		t.Fatalf("a = %q (err=%v), want 1", val, err)
+	}
+	txn.Put("a", []byte("2"))
+	txn.Delete("b")
+	if val, err := txn.Get("a"); err != nil || string(val) != "2" {
+		t.Fatalf("a = %q (err=%v) in txn, want 2", val, err)
+	}
+	if _, err := txn.Get("b"); err != ErrKeyNotFound {
+		t.Fatalf("b should be deleted in txn, got err=%v", err)
+	}
+	if val, _ := db.Get("a"); string(val) != "1" {
+		t.Fatalf("uncommitted write visible: a = %q", val)
+	}
+	// A write to a key the transaction didn't read is no conflict.
+	db.Put("c", []byte("1"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err == nil {
+		t.Fatal("second commit should fail")
+	}
+	if val, err := db.Get("a"); err != nil || string(val) != "2" {
+		t.Fatalf("a = %q (err=%v) after commit, want 2", val, err)
+	}
+	if _, err := db.Get("b"); err != ErrKeyNotFound {
+		t.Fatalf("b should be deleted after commit, got err=%v", err)
+	}
+
+	// A key read by the transaction and written since, whether still
+	// in the memtable, flushed, or deleted by a range, is a conflict.
+	for name, change := range map[string]func(){
+		"memtable": func() { db.Put("a", []byte("3")) },
+		"flushed":  func() { db.Put("a", []byte("3")); db.Flush() },
+		"range":    func() { db.DeleteRange("a", "b") },
+	} {
+		db.Put("a", []byte("3"))
+		txn := db.BeginTxn()
+		txn.Get("a")
+		txn.Put("d", []byte(name))
+		change()
+		if err := txn.Commit(); err != ErrConflict {
+			t.Fatalf("%s: commit returned %v, want ErrConflict", name, err)
+		}
+		if _, err := db.Get("d"); err != ErrKeyNotFound {
+			t.Fatalf("%s: conflicting transaction was applied", name)
+		}
+	}
+
+	// The commit is logged as one record and survives a crash.
+	txn = db.BeginTxn()
+	txn.Put("e", []byte("1"))
+	txn.Put("f", []byte("1"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.stopBackground()
+	db2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	for _, key := range []string{"e", "f"} {
+		if val, err := db2.Get(key); err != nil || string(val) != "1" {
+			t.Fatalf("%s = %q (err=%v) after recovery", key, val, err)
+		}
+	}
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(dir, &Options{SyncMode: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("counter", []byte("0"))
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				txn := db.BeginTxn()
+				val, err := txn.Get("counter")
+				if err != nil {
+					t.Error(err)
+					txn.Rollback()
+					return
+				}
+				var n int
+				fmt.Sscan(string(val), &n)
+				txn.Put("counter", []byte(fmt.Sprint(n+1)))
+				switch err := txn.Commit(); err {
+				case nil:
+					i++
+				case ErrConflict:
+				default:
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, err := db.Get("counter"); err != nil || string(val) != fmt.Sprint(workers*increments) {
+		t.Fatalf("counter = %q (err=%v), want %d", val, err, workers*increments)
+	}
+}
@@ -0,0 +1,408 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Background flush
+//
+// When the active memtable fills up, the next write freezes it into
+// an immutable memtable and starts a fresh one that logs to a new WAL
+// segment. Segments are named NNNNNN.log and numbered from the same
+// counter as SSTables, so a later segment always has a higher
+// number; an existing segment is never renamed or reopened for
+// writing. A background goroutine flushes immutable memtables oldest
+// first. Writers only stall when Options.MaxImmutableMemtables are
+// already waiting.
+//
+// Flushing a memtable logs the number of the first segment it does
+// not cover to the MANIFEST along with its SSTable. Segments below
+// that number hold nothing the SSTables lack, so they are retired —
+// deleted, or moved to Options.WALArchiveDir — only after the edit
+// is durable. Open replays every segment from that number up, in
+// order.
+
+// immutable is a frozen memtable waiting to be flushed. Every WAL
+// segment numbered below logNum holds only writes in this memtable
+// or older ones.
+type immutable struct {
+	mem    *Memtable
+	logNum int
+}
+
+// logPath returns the path of a WAL segment.
+func (db *DB) logPath(num int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d.log", num))
+}
+
+// parseLogName extracts the number from a WAL segment file name.
+func parseLogName(name string) (int, bool) {
+	if !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	num, err := strconv.Atoi(strings.TrimSuffix(name, ".log"))
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// logFiles returns the numbers of the WAL segments in the
+// directory, oldest first.
+func (db *DB) logFiles() ([]int, error) {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, e := range entries {
+		if num, ok := parseLogName(e.Name()); ok {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// createLog creates WAL segment num and fsyncs the directory so the
+// new file survives a crash.
+func (db *DB) createLog(num int) (*WAL, error) {
+	wal, err := openWAL(db.logPath(num), db.opts.walOptions())
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(db.dir); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// retireLogs retires every WAL segment numbered below num. The
+// MANIFEST must already record that those segments are flushed.
+func (db *DB) retireLogs(num int) {
+	nums, err := db.logFiles()
+	if err != nil {
+		db.opts.Logger.Printf("retire wal segments: %v", err)
+		return
+	}
+	for _, n := range nums {
+		if n < num {
+			db.retireLog(n)
+		}
+	}
+}
+
+// retireLog deletes a flushed WAL segment, or moves it into
+// Options.WALArchiveDir if one is set. A segment that cannot be
+// archived is left in place and tried again on the next Open.
+func (db *DB) retireLog(num int) {
+	path := db.logPath(num)
+	if db.opts.WALArchiveDir == "" {
+		os.Remove(path)
+		return
+	}
+	if err := os.MkdirAll(db.opts.WALArchiveDir, db.opts.DirMode); err != nil {
+		db.opts.Logger.Printf("archive wal segment %s: %v", path, err)
+		return
+	}
+	if err := os.Rename(path, filepath.Join(db.opts.WALArchiveDir, filepath.Base(path))); err != nil {
+		db.opts.Logger.Printf("archive wal segment %s: %v", path, err)
+	}
+}
+
+// recoverWAL replays the live WAL segments, oldest first, and opens
+// a new segment for writes. Each segment but the newest was frozen
+// with a memtable that was waiting to be flushed when we last
+// stopped; those are rebuilt for the flusher to finish. The newest
+// is replayed into the active memtable. New writes always go to a
+// new segment, so a torn record at the end of an old one can never
+// hide them. Called during Open, after the MANIFEST is loaded.
+func (db *DB) recoverWAL() error {
+	if err := db.adoptLegacyWALs(); err != nil {
+		return err
+	}
+	nums, err := db.logFiles()
+	if err != nil {
+		return err
+	}
+	var live []int
+	for _, num := range nums {
+		if num >= db.nextSeq {
+			db.nextSeq = num + 1
+		}
+		if num < db.minLogNum {
+			// Flushed, but we stopped before retiring it.
+			db.retireLog(num)
+			continue
+		}
+		if info, err := os.Stat(db.logPath(num)); err == nil && info.Size() == 0 {
+			os.Remove(db.logPath(num))
+			continue
+		}
+		live = append(live, num)
+	}
+
+	for i, num := range live {
+		entries, err := replayWAL(db.logPath(num), db.opts.MaxWALRecordSize)
+		if err != nil {
+			return err
+		}
+		db.sequenceReplayed(entries)
+		if i == len(live)-1 {
+			applyEntries(db.mem, entries)
+			break
+		}
+		mem := db.newMemtable()
+		applyEntries(mem, entries)
+		db.imm = append([]*immutable{{mem: mem, logNum: live[i+1]}}, db.imm...)
+	}
+
+	num := db.nextSeq
+	db.nextSeq++
+	wal, err := db.createLog(num)
+	if err != nil {
+		return err
+	}
+	db.wal = wal
+	db.logNum = num
+	return nil
+}
+
+// sequenceReplayed advances the last sequence number past replayed
+// entries. Entries logged before sequence numbers existed have none,
+// and are numbered after everything seen so far in log order.
+func (db *DB) sequenceReplayed(entries []WALEntry) {
+	last := db.lastSeqNum.Load()
+	for i := range entries {
+		if entries[i].Seq == 0 {
+			entries[i].Seq = last + 1
+		}
+		last = max(last, entries[i].Seq)
+	}
+	db.lastSeqNum.Store(last)
+}
+
+// adoptLegacyWALs renames the WAL files of a directory written
+// before numbered segments — frozen wal.NNNNNN files, then the active
+// wal — to new segment numbers in that order, so they are replayed
+// like any other segment.
+func (db *DB) adoptLegacyWALs() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	type legacyWAL struct {
+		name string
+		seq  int
+	}
+	var wals []legacyWAL
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "wal.") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "wal."))
+		if err != nil {
+			continue
+		}
+		wals = append(wals, legacyWAL{name: e.Name(), seq: seq})
+	}
+	sort.Slice(wals, func(i, j int) bool {
+		return wals[i].seq < wals[j].seq
+	})
+	if _, err := os.Stat(filepath.Join(db.dir, "wal")); err == nil {
+		wals = append(wals, legacyWAL{name: "wal"})
+	}
+	if len(wals) == 0 {
+		return nil
+	}
+
+	// Number them after any segment already present: those can only
+	// be legacy files adopted before a crash cut this loop short.
+	nums, err := db.logFiles()
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num >= db.nextSeq {
+			db.nextSeq = num + 1
+		}
+	}
+	for _, w := range wals {
+		num := db.nextSeq
+		db.nextSeq++
+		if err := os.Rename(filepath.Join(db.dir, w.name), db.logPath(num)); err != nil {
+			return err
+		}
+	}
+	return syncDir(db.dir)
+}
+
+// makeRoomForWrite rotates a full memtable before the next write is
+// applied. If too many immutable memtables are already queued it
+// waits for the flusher to catch up. Called by the commit leader
+// with db.mu held.
+func (db *DB) makeRoomForWrite() error {
+	for db.mem.IsFull() {
+		if db.bgErr != nil {
+			return db.bgErr
+		}
+		if len(db.imm) >= db.opts.MaxImmutableMemtables {
+			db.flushCond.Wait()
+			continue
+		}
+		return db.rotateMemtable()
+	}
+	return nil
+}
+
+// rotateMemtable freezes the active memtable and starts a fresh one
+// logging to a new WAL segment. The old segment is fsynced first, as
+// the background syncer and SyncWAL only reach the active one.
+// Called by the commit leader with db.mu held.
+func (db *DB) rotateMemtable() error {
+	if err := db.wal.Sync(); err != nil {
+		return fmt.Errorf("db rotate wal: %w", err)
+	}
+	num := db.nextSeq
+	wal, err := db.createLog(num)
+	if err != nil {
+		return fmt.Errorf("db rotate wal: %w", err)
+	}
+	db.nextSeq++
+	if err := db.wal.Close(); err != nil {
+		wal.Close()
+		return fmt.Errorf("db rotate wal: %w", err)
+	}
+	db.wal = wal
+	db.logNum = num
+
+	db.imm = append([]*immutable{{mem: db.mem, logNum: num}}, db.imm...)
+	db.mem = db.newMemtable()
+	db.scheduleFlush()
+	return nil
+}
+
+// newMemtable returns an empty memtable built with the configured
+// MemtableRep.
+func (db *DB) newMemtable() *Memtable {
+	return newMemtable(db.opts.MemtableSize, db.opts.MemtableRep())
+}
+
+// scheduleFlush wakes the flusher without blocking.
+func (db *DB) scheduleFlush() {
+	select {
+	case db.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop flushes immutable memtables in the background until the
+// database is closed. A failed flush is recorded in db.bgErr, which
+// makes later writes fail instead of queueing forever.
+func (db *DB) flushLoop() {
+	defer db.bgWG.Done()
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-db.flushCh:
+		}
+		for {
+			select {
+			case <-db.bgStop:
+				return
+			default:
+			}
+			flushed, err := db.flushOldestImmutable()
+			if err != nil {
+				db.opts.Logger.Printf("background flush: %v", err)
+				db.mu.Lock()
+				db.bgErr = err
+				db.flushCond.Broadcast()
+				db.mu.Unlock()
+				return
+			}
+			if !flushed {
+				break
+			}
+		}
+	}
+}
+
+// flushOldestImmutable writes the oldest immutable memtable to a new
+// level-0 SSTable, logs it to the MANIFEST, retires the WAL segments
+// it covers, installs it, and wakes the compaction worker. It reports
+// false when the queue is empty. Called without db.mu held, from the
+// flusher or from Close once the flusher has stopped.
+func (db *DB) flushOldestImmutable() (bool, error) {
+	db.mu.Lock()
+	if len(db.imm) == 0 {
+		db.mu.Unlock()
+		return false, nil
+	}
+	imm := db.imm[len(db.imm)-1]
+	seq := db.nextSeq
+	db.nextSeq++
+	oldest := db.oldestSnapshot()
+	db.mu.Unlock()
+
+	// The memtable is frozen, so it can be read without the lock.
+	// Versions no snapshot can see are left out, but tombstones are
+	// kept to hide older versions in SSTables.
+	entries := dropShadowed(memtableEntries(imm.mem), oldest, false)
+	entries, rangeDels := dropCovered(entries, imm.mem.rangeTombstones(maxSeqNum), oldest, false)
+	path := db.sstPath(0, seq)
+	if err := writeSSTable(path, entries, rangeDels, db.opts.tableOptions(0)); err != nil {
+		return false, fmt.Errorf("db flush: %w", err)
+	}
+	reader, err := db.openTable(path, seq)
+	if err != nil {
+		return false, fmt.Errorf("db open flushed sst: %w", err)
+	}
+	t := newTableMeta(0, seq, reader)
+	db.tables.insert(seq, reader)
+	edit := &versionEdit{added: []*tableMeta{t}, logNum: imm.logNum, lastSeqNum: db.lastSeqNum.Load()}
+	if err := db.manifest.logEdit(edit); err != nil {
+		db.tables.evict(seq)
+		return false, fmt.Errorf("db flush: %w", err)
+	}
+
+	// The SSTable is durable, so the memtable's WAL segments can go.
+	// They are retired before the swap so that Flush, which waits for
+	// the queue to drain, returns with them gone.
+	db.retireLogs(imm.logNum)
+
+	// Swap the memtable for its SSTable in one step so readers see
+	// the data in exactly one place.
+	db.mu.Lock()
+	db.levels[0] = append([]*tableMeta{t}, db.levels[0]...)
+	db.imm = db.imm[:len(db.imm)-1]
+	db.minLogNum = imm.logNum
+	db.flushCond.Broadcast()
+	db.mu.Unlock()
+	db.scheduleCompaction()
+	return true, nil
+}
+
+// memtableEntries converts memtable entries to SSTable entries.
+func memtableEntries(m *Memtable) []SSTableEntry {
+	memEntries := m.Entries()
+	sstEntries := make([]SSTableEntry, len(memEntries))
+	for i, e := range memEntries {
+		sstEntries[i] = SSTableEntry{
+			Key:       e.key,
+			Seq:       e.seq,
+			Value:     e.value,
+			ExpiresAt: e.expiresAt,
+			Tombstone: e.kind == KindTombstone,
+			Merge:     e.kind == KindMerge,
+		}
+	}
+	return sstEntries
+}
@@ -0,0 +1,511 @@
+package lsm
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// Iterator walks live keys in ascending order across the memtables
+// and every SSTable. It merges the sources the same way kWayMerge
+// does: of the versions of a key no newer than the iterator's
+// sequence number, the newest one wins, and keys whose winning
+// version is a tombstone or lies under a newer range tombstone are
+// hidden.
+//
+// A key whose newest version is a merge operand is resolved with
+// the database's MergeOperator (see merge.go).
+//
+// SSTables are opened only once the iterator reaches their key
+// range (see tableIterator). Each table the iterator may read is
+// pinned, so compaction leaves its file in place until then.
+//
+// An Iterator starts out unpositioned; call Seek before reading.
+// It must be closed when done so that SSTables removed by compaction
+// can release their file handles.
+type Iterator struct {
+	db      *DB
+	sources []entryIterator  // newest first
+	seq     uint64           // versions newer than this are skipped
+	now     int64            // values expired at this time are hidden
+	tombs   []rangeTombstone // range tombstones of the sources opened so far
+	ranges  *rangeDelIndex   // tombs visible at seq
+	merge   MergeOperator
+	tables  []*tableMeta // pinned
+	cur     SSTableEntry
+	valid   bool
+	err     error
+}
+
+// entryIterator is a cursor over a single source in internal order.
+// Entries are returned as SSTableEntry values so the memtable and
+// SSTables can be merged without caring where an entry came from.
+type entryIterator interface {
+	seek(key string)
+	next()
+	valid() bool
+	entry() SSTableEntry
+	// err reports damage that stopped the cursor early.
+	err() error
+}
+
+// NewIterator returns an iterator over the database as of when it
+// is created; later writes are not visible through it. Iterating a
+// closed database yields no keys. An iterator that can't open an
+// SSTable stops there; Err reports why.
+func (db *DB) NewIterator() *Iterator {
+	return db.NewIteratorWithOptions(nil)
+}
+
+// NewIteratorWithOptions is NewIterator with per-read options. With
+// ReadOptions.Snapshot set, it iterates the snapshot instead.
+func (db *DB) NewIteratorWithOptions(ro *ReadOptions) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.newIterator(ro, nil)
+}
+
+// newIterator builds an iterator over the memtables and the SSTables
+// for which include returns true, or every SSTable if include is
+// nil. The caller must hold db.mu.
+func (db *DB) newIterator(ro *ReadOptions, include func(*tableMeta) bool) *Iterator {
+	it := &Iterator{db: db}
+	if db.closed {
+		return it
+	}
+	it.seq = ro.readSeq(db)
+	it.now = db.now()
+	it.merge = db.opts.MergeOperator
+	it.tombs = db.mem.rangeTombstones(it.seq)
+	it.sources = append(it.sources, newMemIterator(db.mem))
+	for _, imm := range db.imm {
+		it.tombs = append(it.tombs, imm.mem.rangeTombstones(it.seq)...)
+		it.sources = append(it.sources, newMemIterator(imm.mem))
+	}
+	// Levels are visited in order, and level 0 newest first, so of
+	// two copies of a version written before sequence numbers, the
+	// newer one always comes from an earlier source.
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			if include != nil && !include(t) {
+				continue
+			}
+			t.pins.Add(1)
+			it.tables = append(it.tables, t)
+			it.sources = append(it.sources, &tableIterator{it: it, t: t, verify: ro.verifyChecksums(), done: true})
+		}
+	}
+	it.ranges = newRangeDelIndex(it.tombs, it.seq)
+	return it
+}
+
+// addRangeDels indexes the range tombstones of a newly opened table.
+func (it *Iterator) addRangeDels(tombs []rangeTombstone) {
+	it.tombs = append(it.tombs, tombs...)
+	it.ranges = newRangeDelIndex(it.tombs, it.seq)
+}
+
+// Seek positions the iterator at the first live key >= key.
+// Seek("") positions it at the first key in the database.
+func (it *Iterator) Seek(key string) {
+	for _, src := range it.sources {
+		src.seek(key)
+	}
+	it.findNext()
+}
+
+// Next advances to the next live key.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.findNext()
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position.
+func (it *Iterator) Key() string {
+	return it.cur.Key
+}
+
+// Value returns the value at the current position. The caller must
+// not modify the returned slice.
+func (it *Iterator) Value() []byte {
+	return it.cur.Value
+}
+
+// Err returns the error, if any, that stopped the iterator early,
+// such as an SSTable it couldn't open. An iterator that reaches
+// damaged data becomes invalid and Err returns an error wrapping
+// ErrCorruption, so a loop that stops at !Valid() should check Err
+// to tell the end of the data from a failure.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the SSTables held by the iterator.
+func (it *Iterator) Close() error {
+	for _, src := range it.sources {
+		if ti, ok := src.(*tableIterator); ok {
+			ti.release()
+		}
+	}
+	for _, t := range it.tables {
+		it.db.unpinTable(t)
+	}
+	it.tables = nil
+	it.sources = nil
+	it.valid = false
+	return nil
+}
+
+// findNext moves to the smallest key across all sources, letting its
+// newest visible version win and skipping deleted keys. Every source is
+// advanced past all versions of that key, which are gathered when the
+// winner is a merge operand. A source that fails stops the iterator,
+// since skipping it could surface stale versions.
+func (it *Iterator) findNext() {
+	for {
+		var winner SSTableEntry
+		minSrc := -1
+		for i, src := range it.sources {
+			for src.valid() && src.entry().Seq > it.seq {
+				src.next()
+			}
+			if err := src.err(); err != nil {
+				it.fail(err)
+				return
+			}
+			if !src.valid() {
+				continue
+			}
+			// On a tie, which only versions written before sequence
+			// numbers can have, the earlier and newer source wins,
+			// unless the later one is a table not yet opened.
+			e := src.entry()
+			c := compareInternal(e.Key, e.Seq, winner.Key, winner.Seq)
+			if minSrc == -1 || c < 0 || c == 0 && unopened(src) {
+				winner = e
+				minSrc = i
+			}
+		}
+		if minSrc == -1 {
+			it.valid = false
+			it.cur = SSTableEntry{}
+			return
+		}
+		if src := it.sources[minSrc]; unopened(src) {
+			// The table may hold this key or a smaller one; open it
+			// and look again.
+			src.next()
+			continue
+		}
+
+		var versions []SSTableEntry
+		for _, src := range it.sources {
+			for src.valid() && src.entry().Key == winner.Key {
+				if e := src.entry(); winner.Merge && e.Seq <= it.seq {
+					versions = append(versions, e)
+				}
+				src.next()
+			}
+		}
+
+		if winner.Tombstone || expired(winner.ExpiresAt, it.now) || it.ranges.covers(winner.Key, winner.Seq) {
+			continue
+		}
+		if winner.Merge {
+			for _, src := range it.sources {
+				if err := src.err(); err != nil {
+					it.fail(err)
+					return
+				}
+			}
+			// Sources hold older versions the later they come, so a
+			// stable sort keeps the newer of two unsequenced copies
+			// first.
+			slices.SortStableFunc(versions, func(a, b SSTableEntry) int {
+				return cmp.Compare(b.Seq, a.Seq)
+			})
+			value, err := fullMerge(it.merge, winner.Key, versions, it.now, it.ranges)
+			if err != nil {
+				it.fail(err)
+				return
+			}
+			winner = SSTableEntry{Key: winner.Key, Seq: winner.Seq, Value: value}
+		}
+		it.cur = winner
+		it.valid = true
+		return
+	}
+}
+
+// fail stops the iterator with err.
+func (it *Iterator) fail(err error) {
+	it.err = err
+	it.valid = false
+	it.cur = SSTableEntry{}
+}
+
+// tableIterator is a cursor over an installed SSTable that opens
+// the table only once the iterator reaches its key range, and
+// releases it again once past the end. Until then it stands at a
+// placeholder for the first key the table may hold, ordered before
+// every visible version of that key, which findNext opens as soon
+// as it wins. The table's range tombstones are added to the
+// iterator's when it is first opened; they only cover keys inside
+// its range, none of which the iterator has returned yet.
+type tableIterator struct {
+	it     *Iterator
+	t      *tableMeta
+	verify bool
+	r      *SSTableReader // nil until opened and once released
+	src    entryIterator
+	target string // where to seek once opened
+	loaded bool   // the table's range tombstones have been added
+	done   bool   // unpositioned or past the end
+	fail   error
+}
+
+func (ti *tableIterator) seek(key string) {
+	ti.release()
+	ti.target = max(key, ti.t.smallest)
+	ti.done = key > ti.t.largest
+}
+
+func (ti *tableIterator) next() {
+	if ti.r == nil {
+		ti.open()
+		return
+	}
+	ti.src.next()
+	ti.check()
+}
+
+func (ti *tableIterator) valid() bool {
+	return ti.fail == nil && !ti.done && (ti.r == nil || ti.src.valid())
+}
+
+func (ti *tableIterator) entry() SSTableEntry {
+	if ti.r == nil {
+		return SSTableEntry{Key: ti.target, Seq: ti.it.seq}
+	}
+	return ti.src.entry()
+}
+
+func (ti *tableIterator) err() error { return ti.fail }
+
+// open reads the table through the table cache and seeks to target.
+func (ti *tableIterator) open() {
+	r, err := ti.it.db.tables.get(ti.t)
+	if err != nil {
+		ti.fail = err
+		return
+	}
+	ti.r = r
+	if !ti.loaded {
+		ti.loaded = true
+		if len(r.rangeDels) > 0 {
+			ti.it.addRangeDels(r.rangeDels)
+		}
+	}
+	ti.src = newSSTableIterator(r, ti.verify)
+	ti.src.seek(ti.target)
+	ti.check()
+}
+
+// check releases the table once the cursor has run off its end,
+// keeping any error that stopped it.
+func (ti *tableIterator) check() {
+	if ti.src.valid() {
+		return
+	}
+	if err := ti.src.err(); err != nil {
+		ti.fail = err
+	}
+	ti.release()
+	ti.done = true
+}
+
+// release drops the table's reader, if open.
+func (ti *tableIterator) release() {
+	if ti.r != nil {
+		ti.r.Close()
+		ti.r = nil
+		ti.src = nil
+	}
+}
+
+// unopened reports whether src is a table the iterator has yet to
+// open.
+func unopened(src entryIterator) bool {
+	ti, ok := src.(*tableIterator)
+	return ok && ti.r == nil && ti.valid()
+}
+
+// memIterator iterates over a memtable. Versions written after the
+// iterator was created are skipped by their sequence numbers, so the
+// memtable is read in place rather than copied.
+type memIterator struct {
+	it  MemtableIterator
+	cur SSTableEntry
+}
+
+func newMemIterator(m *Memtable) *memIterator {
+	return &memIterator{it: m.rep.NewIterator()}
+}
+
+func (mi *memIterator) seek(key string) {
+	mi.it.Seek(key)
+	mi.load()
+}
+
+func (mi *memIterator) next() {
+	mi.it.Next()
+	mi.load()
+}
+
+func (mi *memIterator) valid() bool         { return mi.it.Valid() }
+func (mi *memIterator) entry() SSTableEntry { return mi.cur }
+func (mi *memIterator) err() error          { return nil }
+
+func (mi *memIterator) load() {
+	mi.cur = SSTableEntry{}
+	if mi.it.Valid() {
+		mi.cur = SSTableEntry{
+			Key:       mi.it.Key(),
+			Seq:       mi.it.Seq(),
+			Value:     mi.it.Value(),
+			ExpiresAt: mi.it.ExpiresAt(),
+			Tombstone: mi.it.Kind() == KindTombstone,
+			Merge:     mi.it.Kind() == KindMerge,
+		}
+	}
+}
+
+// newSSTableIterator returns an unpositioned cursor over an SSTable.
+// verify checks the checksum of each data block read from disk.
+func newSSTableIterator(r *SSTableReader, verify bool) entryIterator {
+	if r.version == 1 {
+		return &sstV1Iterator{r: r, pos: len(r.index)}
+	}
+	return &sstIterator{r: r, verify: verify, block: len(r.blocks)}
+}
+
+// sstIterator iterates over an SSTable one data block at a time,
+// reading each block from disk as it is reached.
+type sstIterator struct {
+	r      *SSTableReader
+	verify bool
+	block  int        // index of the current data block
+	bi     *blockIter // nil when unpositioned or past the end
+	cur    SSTableEntry
+	fail   error
+}
+
+func (si *sstIterator) seek(key string) {
+	si.block = si.r.findBlock(key, maxSeqNum)
+	if si.load() {
+		si.bi.seek(key, maxSeqNum)
+	}
+	si.skipExhausted()
+}
+
+func (si *sstIterator) next() {
+	si.bi.advance()
+	si.skipExhausted()
+}
+
+func (si *sstIterator) valid() bool         { return si.bi != nil && si.bi.valid }
+func (si *sstIterator) entry() SSTableEntry { return si.cur }
+func (si *sstIterator) err() error          { return si.fail }
+
+// load opens the current block. It reports false past the last
+// block or if the block can't be read, recording the error.
+func (si *sstIterator) load() bool {
+	si.bi = nil
+	if si.block >= len(si.r.blocks) {
+		return false
+	}
+	bi, err := si.r.openBlock(si.block, si.verify)
+	if err != nil {
+		si.fail = err
+		return false
+	}
+	si.bi = bi
+	return true
+}
+
+// skipExhausted moves on to the first entry of the next block while
+// the current one has none left. It stops at the first block that
+// can't be read or decoded.
+func (si *sstIterator) skipExhausted() {
+	for si.fail == nil && !si.valid() && si.block < len(si.r.blocks) {
+		if si.bi != nil && si.bi.err != nil {
+			si.fail = si.r.blockError(si.block, si.bi.err)
+			si.bi = nil
+			break
+		}
+		si.block++
+		if si.load() {
+			si.bi.first()
+		}
+	}
+	if !si.valid() {
+		si.cur = SSTableEntry{}
+		return
+	}
+	si.cur = SSTableEntry{
+		Key:       string(si.bi.key),
+		Seq:       si.bi.seq,
+		Value:     si.bi.value,
+		ExpiresAt: si.bi.expiresAt,
+		Tombstone: si.bi.kind == kindTombstone,
+		Merge:     si.bi.kind == kindMerge,
+	}
+}
+
+// sstV1Iterator iterates over a v1 SSTable using its in-memory
+// index, reading each entry from disk as it is reached.
+type sstV1Iterator struct {
+	r    *SSTableReader
+	pos  int
+	cur  SSTableEntry
+	fail error
+}
+
+func (si *sstV1Iterator) seek(key string) {
+	si.pos = sort.Search(len(si.r.index), func(i int) bool {
+		return si.r.index[i].Key >= key
+	})
+	si.load()
+}
+
+func (si *sstV1Iterator) next() {
+	si.pos++
+	si.load()
+}
+
+func (si *sstV1Iterator) valid() bool         { return si.fail == nil && si.pos < len(si.r.index) }
+func (si *sstV1Iterator) entry() SSTableEntry { return si.cur }
+func (si *sstV1Iterator) err() error          { return si.fail }
+
+// load reads the entry at the current position, stopping the
+// iterator if it can't be read.
+func (si *sstV1Iterator) load() {
+	si.cur = SSTableEntry{}
+	if si.fail != nil || si.pos >= len(si.r.index) {
+		return
+	}
+	idx := si.r.index[si.pos]
+	val, tomb, err := si.r.readEntry(idx.Offset)
+	if err != nil {
+		si.fail = err
+		return
+	}
+	si.cur = SSTableEntry{Key: idx.Key, Value: val, Tombstone: tomb}
+}
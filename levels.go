@@ -0,0 +1,147 @@
+package lsm
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Levels
+//
+// SSTables are organized into Options.NumLevels levels. Level 0
+// holds freshly flushed tables, newest first; their key ranges may
+// overlap, so a lookup has to check each one. Under the leveled and
+// merge-all strategies, levels 1 and up hold tables sorted by key
+// with non-overlapping ranges, so a lookup checks at most one table
+// per level. For leveled compaction each level from 1 up has a byte
+// target that grows by LevelSizeMultiplier per level; a level over
+// its target is compacted into the next one.
+
+// tableMeta describes an installed SSTable. Its reader is opened on
+// demand through the table cache.
+type tableMeta struct {
+	level    int
+	seq      int
+	path     string
+	size     int64
+	smallest string
+	largest  string
+
+	// pins counts the iterators that may still open the table. The
+	// file of a table compaction has removed outlives its last pin.
+	pins     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// newTableMeta builds the metadata for an opened SSTable.
+func newTableMeta(level, seq int, r *SSTableReader) *tableMeta {
+	return &tableMeta{
+		level:    level,
+		seq:      seq,
+		path:     r.path,
+		size:     r.size,
+		smallest: r.smallest,
+		largest:  r.largest,
+	}
+}
+
+// overlaps reports whether the table's key range intersects
+// [smallest, largest].
+func (t *tableMeta) overlaps(smallest, largest string) bool {
+	return t.smallest <= largest && t.largest >= smallest
+}
+
+// contains reports whether key falls inside the table's key range.
+func (t *tableMeta) contains(key string) bool {
+	return t.smallest <= key && key <= t.largest
+}
+
+// levelBytes returns the total size of the tables in a level.
+func levelBytes(tables []*tableMeta) int64 {
+	var n int64
+	for _, t := range tables {
+		n += t.size
+	}
+	return n
+}
+
+// keyRange returns the smallest and largest keys across tables.
+func keyRange(tables []*tableMeta) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
+
+// overlapping returns the tables in a level that intersect
+// [smallest, largest].
+func overlapping(tables []*tableMeta, smallest, largest string) []*tableMeta {
+	var out []*tableMeta
+	for _, t := range tables {
+		if t.overlaps(smallest, largest) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// findTable returns the table in a sorted, non-overlapping level
+// whose range contains key, or nil.
+func findTable(tables []*tableMeta, key string) *tableMeta {
+	i := sort.Search(len(tables), func(i int) bool {
+		return tables[i].largest >= key
+	})
+	if i < len(tables) && tables[i].smallest <= key {
+		return tables[i]
+	}
+	return nil
+}
+
+// sortLevel orders a level for lookups: disjoint levels by smallest
+// key, every other level newest first. Called with db.mu held.
+func (db *DB) sortLevel(level int) {
+	tables := db.levels[level]
+	if !db.opts.CompactionStrategy.disjoint(level) {
+		sortBySeq(tables)
+		return
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].smallest < tables[j].smallest
+	})
+}
+
+// sortBySeq orders tables newest first by sequence number.
+func sortBySeq(tables []*tableMeta) {
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].seq > tables[j].seq
+	})
+}
+
+// removeTables returns tables without any of the ones in drop.
+func removeTables(tables, drop []*tableMeta) []*tableMeta {
+	dropped := make(map[*tableMeta]bool, len(drop))
+	for _, t := range drop {
+		dropped[t] = true
+	}
+	out := make([]*tableMeta, 0, len(tables))
+	for _, t := range tables {
+		if !dropped[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// levelTarget returns the byte target for a level >= 1.
+func (o *Options) levelTarget(level int) int64 {
+	target := o.LevelBaseSize
+	for l := 1; l < level; l++ {
+		target *= int64(o.LevelSizeMultiplier)
+	}
+	return target
+}
@@ -0,0 +1,328 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MANIFEST
+//
+// The MANIFEST is the source of truth for which SSTables are live.
+// It is a log of version edits, framed like WAL records, each of
+// which adds and removes tables and advances the next sequence
+// number. CURRENT names the MANIFEST in use and is replaced
+// atomically, so a crash leaves either the old or the new one in
+// effect. New SSTables are written under a temporary name and
+// renamed into place with the directory fsync'd, so a table is
+// complete and durable before any edit lists it. Flushes and
+// compactions then log their edit, fsync'd, before installing the
+// change in memory and before deleting any file.
+//
+// Open replays the MANIFEST named by CURRENT and then starts a new
+// one holding a single snapshot edit, so the log does not grow
+// across restarts. Any .sst file the MANIFEST does not list is a
+// leftover from an interrupted flush or compaction and is deleted,
+// unless replay stopped at a torn record at the end of the log. A
+// damaged record with more records after it is not a torn append,
+// and fails Open with an error wrapping ErrCorruption rather than
+// silently dropping the edits that follow it.
+// A directory without CURRENT is either new or was written before
+// the MANIFEST existed; its tables are found by listing the
+// directory one last time.
+//
+// Edits from flushes also record the oldest WAL segment whose writes
+// are not yet in an SSTable (see flush.go), and the last sequence
+// number written (see snapshot.go), which the retired segments no
+// longer hold.
+
+const currentFileName = "CURRENT"
+
+// Version edit record tags.
+const (
+	editNextSeq     byte = 1
+	editAddTable    byte = 2
+	editDeleteTable byte = 3
+	editLogNum      byte = 4
+	editLastSeqNum  byte = 5
+)
+
+// versionEdit is one change to the set of live tables.
+type versionEdit struct {
+	added   []*tableMeta
+	deleted []*tableMeta
+	nextSeq int // raised to past the highest added seq when encoded
+	logNum  int // oldest WAL segment still needed; 0 leaves it unchanged
+
+	// lastSeqNum is a lower bound on the last write sequence number;
+	// 0 leaves it unchanged.
+	lastSeqNum uint64
+}
+
+// encode serializes the edit. Numbers are little-endian; keys are
+// length-prefixed like WAL keys.
+//
+//	nextSeq:  [tag][seq:8]
+//	logNum:   [tag][num:8]
+//	lastSeq:  [tag][seq:8]
+//	add:      [tag][level:4][seq:8][size:8][smallest len:4][smallest][largest len:4][largest]
+//	delete:   [tag][level:4][seq:8]
+func (e *versionEdit) encode() []byte {
+	next := e.nextSeq
+	for _, t := range e.added {
+		if t.seq >= next {
+			next = t.seq + 1
+		}
+	}
+
+	buf := []byte{editNextSeq}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(next))
+	if e.logNum > 0 {
+		buf = append(buf, editLogNum)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.logNum))
+	}
+	if e.lastSeqNum > 0 {
+		buf = append(buf, editLastSeqNum)
+		buf = binary.LittleEndian.AppendUint64(buf, e.lastSeqNum)
+	}
+	for _, t := range e.added {
+		buf = append(buf, editAddTable)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(t.level))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.seq))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.size))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(t.smallest)))
+		buf = append(buf, t.smallest...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(t.largest)))
+		buf = append(buf, t.largest...)
+	}
+	for _, t := range e.deleted {
+		buf = append(buf, editDeleteTable)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(t.level))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.seq))
+	}
+	return buf
+}
+
+// errCorruptEdit is returned for a checksummed MANIFEST record that
+// does not decode.
+var errCorruptEdit = fmt.Errorf("manifest: %w: bad version edit", ErrCorruption)
+
+// decodeEdit parses a record written by encode. Decoded tables carry
+// only their metadata; path and reader are filled in by the caller.
+func decodeEdit(buf []byte) (*versionEdit, error) {
+	d := editDecoder{buf: buf}
+	e := &versionEdit{}
+	for len(d.buf) > 0 && d.err == nil {
+		switch tag := d.byte(); tag {
+		case editNextSeq:
+			e.nextSeq = int(d.uint64())
+		case editLogNum:
+			e.logNum = int(d.uint64())
+		case editLastSeqNum:
+			e.lastSeqNum = d.uint64()
+		case editAddTable:
+			t := &tableMeta{level: int(d.uint32()), seq: int(d.uint64())}
+			t.size = int64(d.uint64())
+			t.smallest = d.string()
+			t.largest = d.string()
+			e.added = append(e.added, t)
+		case editDeleteTable:
+			e.deleted = append(e.deleted, &tableMeta{level: int(d.uint32()), seq: int(d.uint64())})
+		default:
+			return nil, fmt.Errorf("%w: unknown tag %d", errCorruptEdit, tag)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return e, nil
+}
+
+// editDecoder reads fields from an edit, remembering the first
+// out-of-bounds read so callers can check once at the end.
+type editDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *editDecoder) take(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = errCorruptEdit
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *editDecoder) byte() byte     { return d.take(1)[0] }
+func (d *editDecoder) uint32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *editDecoder) uint64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+func (d *editDecoder) string() string { return string(d.take(int(d.uint32()))) }
+
+// manifest is the open MANIFEST log.
+type manifest struct {
+	mu   sync.Mutex
+	log  *WAL // opened with SyncAlways, so every edit is fsync'd
+	name string
+	err  error // sticky: a failed append may have left a torn record
+}
+
+// createManifest writes a new MANIFEST holding snapshot and points
+// CURRENT at it.
+func createManifest(dir string, seq int, snapshot *versionEdit, opts *Options) (*manifest, error) {
+	name := fmt.Sprintf("MANIFEST-%06d", seq)
+	path := filepath.Join(dir, name)
+	// A crash while creating a MANIFEST can leave one with this name
+	// that CURRENT never pointed to.
+	os.Remove(path)
+
+	log, err := openWAL(path, walOptions{
+		maxRecordSize: opts.MaxWALRecordSize,
+		syncMode:      SyncAlways,
+		perm:          opts.FileMode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("manifest create: %w", err)
+	}
+	m := &manifest{log: log, name: name}
+	if err := m.logEdit(snapshot); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := setCurrent(dir, name, opts.FileMode); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// logEdit appends an edit and fsyncs it. After a failure the
+// MANIFEST may end in a torn record that replay would stop at, so
+// every later edit fails too.
+func (m *manifest) logEdit(e *versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if err := m.log.writeRecord(e.encode()); err != nil {
+		m.err = fmt.Errorf("manifest: %w", err)
+		return m.err
+	}
+	return nil
+}
+
+func (m *manifest) close() error {
+	return m.log.Close()
+}
+
+// setCurrent atomically points CURRENT at the named MANIFEST.
+func setCurrent(dir, name string, perm os.FileMode) error {
+	tmp := filepath.Join(dir, currentFileName+tmpSuffix)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return fmt.Errorf("manifest set current: %w", err)
+	}
+	if _, err := f.WriteString(name + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("manifest set current: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("manifest set current: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("manifest set current: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFileName)); err != nil {
+		return fmt.Errorf("manifest set current: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that renames and new files in it
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
+
+// readManifest replays the MANIFEST named by CURRENT and returns the
+// resulting state as a single edit: the live tables, ordered by
+// sequence number, the next sequence number, the oldest live WAL
+// segment, and the last write sequence number. found is false if the
+// directory has no CURRENT file. torn is true if the MANIFEST ends in
+// a partial record, whose edit is ignored; a damaged record anywhere
+// else is an error wrapping ErrCorruption.
+func readManifest(dir string, maxRecordSize int) (state *versionEdit, found, torn bool, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if os.IsNotExist(err) {
+		return nil, false, false, nil
+	}
+	if err != nil {
+		return nil, false, false, fmt.Errorf("manifest read current: %w", err)
+	}
+	name := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(name, "MANIFEST-") || strings.ContainsAny(name, `/\`) {
+		return nil, false, false, fmt.Errorf("manifest: CURRENT names %q", name)
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return nil, false, false, fmt.Errorf("manifest: %w", err)
+	}
+
+	state = &versionEdit{}
+	live := make(map[int]*tableMeta)
+	var decodeErr error
+	err = readRecords(path, maxRecordSize, func(payload []byte) bool {
+		e, err := decodeEdit(payload)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		if e.nextSeq > state.nextSeq {
+			state.nextSeq = e.nextSeq
+		}
+		if e.logNum > state.logNum {
+			state.logNum = e.logNum
+		}
+		if e.lastSeqNum > state.lastSeqNum {
+			state.lastSeqNum = e.lastSeqNum
+		}
+		for _, t := range e.deleted {
+			delete(live, t.seq)
+		}
+		for _, t := range e.added {
+			live[t.seq] = t
+		}
+		return true
+	})
+	torn = errors.Is(err, errTornRecord)
+	if err != nil && !torn {
+		return nil, false, false, fmt.Errorf("manifest: %w", err)
+	}
+	if decodeErr != nil {
+		return nil, false, false, decodeErr
+	}
+
+	for _, t := range live {
+		state.added = append(state.added, t)
+	}
+	sort.Slice(state.added, func(i, j int) bool {
+		return state.added[i].seq < state.added[j].seq
+	})
+	return state, true, torn, nil
+}
@@ -1,113 +1,241 @@
 package lsm
 
-import "sort"
+import "time"
 
+// DefaultMemtableSize is the default flush threshold. It can be
+// changed per database with Options.MemtableSize.
 const DefaultMemtableSize = 4 * 1024 * 1024 // 4 MB
 
-// memEntry is a single key-value pair stored in the memtable.
-// A nil value represents a tombstone (deleted key).
+// memEntry is a single version of a key stored in the memtable.
 type memEntry struct {
 	key       string
+	seq       uint64
+	kind      EntryKind
 	value     []byte
-	tombstone bool
+	expiresAt int64 // Unix nanoseconds; 0 if the value never expires
 }
 
-// Memtable is an in-memory sorted buffer of key-value pairs.
-// It uses a sorted slice with binary search for lookups and
-// insertions. Once the approximate size exceeds the threshold,
-// the caller should flush it to an SSTable.
+// EntryKind is what a version of a key holds.
+type EntryKind byte
+
+const (
+	KindValue     EntryKind = iota // a value written by Put
+	KindTombstone                  // a delete
+	KindMerge                      // a merge operand (see merge.go)
+)
+
+// MemtableRep is the ordered structure that holds a memtable's
+// entries. The default, NewSkiplistRep, is a skiplist; another can be
+// chosen with Options.MemtableRep.
+//
+// Entries are versions of a key, each with its own sequence number
+// (see snapshot.go), and are kept in ascending key order, newest
+// version first within a key. A version is never replaced.
+//
+// A MemtableRep is written by one goroutine at a time, but reads and
+// iterators may run concurrently with that writer, so they must not
+// need a lock to see a consistent structure.
+type MemtableRep interface {
+	// Add inserts a version of key. seq is higher than that of any
+	// version of key already present. A tombstone has no value.
+	// expiresAt is the expiry of a value (see ttl.go), 0 if it has
+	// none.
+	Add(key string, seq uint64, value []byte, kind EntryKind, expiresAt int64)
+	// Get returns the newest version of key with a sequence number
+	// <= seq, if there is one.
+	Get(key string, seq uint64) (value []byte, expiresAt int64, kind EntryKind, found bool)
+	// Len returns the number of entries, counting every version.
+	Len() int
+	// Size returns the bytes of memory allocated for the entries.
+	Size() int
+	// NewIterator returns an unpositioned iterator over the entries
+	// in ascending key order, newest version first.
+	NewIterator() MemtableIterator
+}
+
+// MemtableIterator is a cursor over a MemtableRep.
+type MemtableIterator interface {
+	// Seek moves to the newest version of the first key >= key.
+	Seek(key string)
+	// Next moves to the following entry.
+	Next()
+	// Valid reports whether the iterator is positioned at an entry.
+	Valid() bool
+	Key() string
+	Seq() uint64
+	Value() []byte
+	ExpiresAt() int64
+	Kind() EntryKind
+}
+
+// Memtable is an in-memory sorted buffer of key-value pairs held in
+// a MemtableRep. Range tombstones are kept in a skiplist of their own
+// (see rangedel.go). Once its size reaches the threshold, the caller
+// should flush it to an SSTable.
 type Memtable struct {
-	entries   []memEntry
-	size      int // approximate memory usage in bytes
+	rep       MemtableRep
+	rangeDels MemtableRep // start key -> end key
 	threshold int
+	seq       uint64 // newest sequence number written
 }
 
-// NewMemtable creates a memtable with the given size threshold.
+// NewMemtable creates a skiplist memtable with the given size
+// threshold.
 func NewMemtable(threshold int) *Memtable {
+	return newMemtable(threshold, NewSkiplistRep())
+}
+
+func newMemtable(threshold int, rep MemtableRep) *Memtable {
 	return &Memtable{
+		rep:       rep,
+		rangeDels: NewSkiplistRep(),
 		threshold: threshold,
 	}
 }
 
-// Put inserts or updates a key-value pair.
+// Put adds key with value as a version newer than any the memtable
+// holds. The value is copied.
 func (m *Memtable) Put(key string, value []byte) {
-	idx := m.search(key)
-
-	if idx < len(m.entries) && m.entries[idx].key == key {
-		// Update existing entry — adjust size tracking
-		m.size -= len(m.entries[idx].value)
-		m.entries[idx].value = value
-		m.entries[idx].tombstone = false
-		m.size += len(value)
-		return
+	m.put(key, m.seq+1, value)
+}
+
+// Get retrieves the newest value of key. Returns (value, true) if
+// found, (nil, true) if the key was deleted (tombstone, range
+// tombstone, or expiry), or (nil, false) if the key was never
+// written. A merge operand is returned as the value; DB.Get folds
+// operands into the versions below them.
+func (m *Memtable) Get(key string) ([]byte, bool) {
+	value, kind, found := m.get(key, maxSeqNum, time.Now().UnixNano())
+	if kind == KindTombstone {
+		return nil, found
 	}
+	return value, found
+}
 
-	// Insert new entry at the correct sorted position
-	entry := memEntry{key: key, value: value}
-	m.entries = append(m.entries, memEntry{}) // grow by one
-	copy(m.entries[idx+1:], m.entries[idx:])
-	m.entries[idx] = entry
-	m.size += len(key) + len(value) + 1 // +1 for tombstone flag overhead
+// Delete marks a key as deleted by inserting a tombstone newer than
+// any version the memtable holds.
+func (m *Memtable) Delete(key string) {
+	m.delete(key, m.seq+1)
 }
 
-// Get retrieves the value for a key. Returns (value, true) if found,
-// (nil, true) if the key was deleted (tombstone), or (nil, false) if
-// the key was never written.
-func (m *Memtable) Get(key string) ([]byte, bool) {
-	idx := m.search(key)
-	if idx < len(m.entries) && m.entries[idx].key == key {
-		if m.entries[idx].tombstone {
-			return nil, true // deleted
+// put adds a version of key with sequence number seq. The value is
+// copied.
+func (m *Memtable) put(key string, seq uint64, value []byte) {
+	m.putExpiring(key, seq, value, 0)
+}
+
+// putExpiring is put for a value that expires at expiresAt, in Unix
+// nanoseconds.
+func (m *Memtable) putExpiring(key string, seq uint64, value []byte, expiresAt int64) {
+	m.rep.Add(key, seq, value, KindValue, expiresAt)
+	m.seq = max(m.seq, seq)
+}
+
+// merge adds a merge operand for key with sequence number seq. The
+// operand is copied.
+func (m *Memtable) merge(key string, seq uint64, operand []byte) {
+	m.rep.Add(key, seq, operand, KindMerge, 0)
+	m.seq = max(m.seq, seq)
+}
+
+// get retrieves the newest version of key as of sequence number seq,
+// at time now in Unix nanoseconds. A key deleted by a tombstone, a
+// range tombstone, or expiry is reported as KindTombstone. found is
+// false if the key was not yet written.
+func (m *Memtable) get(key string, seq uint64, now int64) (value []byte, kind EntryKind, found bool) {
+	if covered := m.coveringSeq(key, seq); covered > 0 {
+		// Only a version written after the range tombstone survives.
+		it := m.rep.NewIterator()
+		for it.Seek(key); it.Valid() && it.Key() == key && it.Seq() > seq; it.Next() {
+		}
+		if !it.Valid() || it.Key() != key || it.Seq() < covered || expired(it.ExpiresAt(), now) {
+			return nil, KindTombstone, true
 		}
-		return m.entries[idx].value, true
+		return it.Value(), it.Kind(), true
+	}
+	value, expiresAt, kind, found := m.rep.Get(key, seq)
+	if found && expired(expiresAt, now) {
+		return nil, KindTombstone, true
 	}
-	return nil, false
+	return value, kind, found
 }
 
-// Delete marks a key as deleted by inserting a tombstone.
-func (m *Memtable) Delete(key string) {
-	idx := m.search(key)
+// delete marks a key as deleted as of sequence number seq by
+// inserting a tombstone.
+func (m *Memtable) delete(key string, seq uint64) {
+	m.rep.Add(key, seq, nil, KindTombstone, 0)
+	m.seq = max(m.seq, seq)
+}
 
-	if idx < len(m.entries) && m.entries[idx].key == key {
-		m.size -= len(m.entries[idx].value)
-		m.entries[idx].value = nil
-		m.entries[idx].tombstone = true
-		return
+// deleteRange marks the keys in [start, end) as deleted as of
+// sequence number seq by inserting a range tombstone.
+func (m *Memtable) deleteRange(start, end string, seq uint64) {
+	m.rangeDels.Add(start, seq, []byte(end), KindValue, 0)
+	m.seq = max(m.seq, seq)
+}
+
+// coveringSeq returns the sequence number of the newest range
+// tombstone no newer than seq that contains key, or 0 if none does.
+func (m *Memtable) coveringSeq(key string, seq uint64) uint64 {
+	var newest uint64
+	it := m.rangeDels.NewIterator()
+	for it.Seek(""); it.Valid() && it.Key() <= key; it.Next() {
+		if key < string(it.Value()) && it.Seq() <= seq && it.Seq() > newest {
+			newest = it.Seq()
+		}
 	}
+	return newest
+}
 
-	// Key doesn't exist yet — insert a tombstone
-	entry := memEntry{key: key, tombstone: true}
-	m.entries = append(m.entries, memEntry{})
-	copy(m.entries[idx+1:], m.entries[idx:])
-	m.entries[idx] = entry
-	m.size += len(key) + 1
+// newestSeq returns the sequence number of the newest write to key,
+// counting range tombstones that cover it, and whether there is one.
+func (m *Memtable) newestSeq(key string) (uint64, bool) {
+	seq := m.coveringSeq(key, maxSeqNum)
+	found := seq > 0
+	it := m.rep.NewIterator()
+	if it.Seek(key); it.Valid() && it.Key() == key {
+		seq, found = max(seq, it.Seq()), true
+	}
+	return seq, found
+}
+
+// rangeTombstones returns the range tombstones no newer than seq,
+// sorted by start key, newest first.
+func (m *Memtable) rangeTombstones(seq uint64) []rangeTombstone {
+	var tombs []rangeTombstone
+	it := m.rangeDels.NewIterator()
+	for it.Seek(""); it.Valid(); it.Next() {
+		if it.Seq() <= seq {
+			tombs = append(tombs, rangeTombstone{start: it.Key(), end: string(it.Value()), seq: it.Seq()})
+		}
+	}
+	return tombs
 }
 
 // IsFull returns true when the memtable has reached its size threshold.
 func (m *Memtable) IsFull() bool {
-	return m.size >= m.threshold
+	return m.Size() >= m.threshold
 }
 
-// Len returns the number of entries (including tombstones).
+// Len returns the number of entries (including tombstones, range
+// tombstones, and older versions).
 func (m *Memtable) Len() int {
-	return len(m.entries)
+	return m.rep.Len() + m.rangeDels.Len()
 }
 
-// Size returns the approximate memory usage in bytes.
+// Size returns the bytes allocated for the memtable's entries,
+// including the structure that orders them.
 func (m *Memtable) Size() int {
-	return m.size
+	return m.rep.Size() + m.rangeDels.Size()
 }
 
-// Entries returns all entries in sorted key order.
-// This is used when flushing the memtable to an SSTable.
+// Entries returns all entries in sorted key order, newest version
+// first. This is used when flushing the memtable to an SSTable.
 func (m *Memtable) Entries() []memEntry {
-	return m.entries
-}
-
-// search returns the index where key would be inserted to keep
-// the slice sorted. If the key exists, it returns its index.
-func (m *Memtable) search(key string) int {
-	return sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].key >= key
-	})
+	entries := make([]memEntry, 0, m.rep.Len())
+	it := m.rep.NewIterator()
+	for it.Seek(""); it.Valid(); it.Next() {
+		entries = append(entries, memEntry{key: it.Key(), seq: it.Seq(), kind: it.Kind(), value: it.Value(), expiresAt: it.ExpiresAt()})
+	}
+	return entries
 }
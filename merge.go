@@ -0,0 +1,190 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Merge operators
+//
+// Merge records an operand for a key instead of a value: a read-
+// modify-write, such as adding to a counter, that is logged without
+// reading the key first. Operands are versions of the key like any
+// other, of kind KindMerge, and the database's MergeOperator turns
+// them into a value.
+//
+// A read resolves a key whose newest visible version is an operand
+// by collecting the key's older versions down to the first one that
+// isn't an operand, the base, and applying every operand to it,
+// oldest first. A tombstone, an expired value, or a range tombstone
+// below the operands leaves the key without a base, as does running
+// out of versions.
+//
+// Compaction folds operands eagerly. Operands every reader sees are
+// applied to their base if the base is among the compaction's
+// inputs, or if nothing older could exist outside them; otherwise
+// they are combined with each other as far as PartialMerge allows,
+// and the rest waits for a later compaction that reaches the base.
+// A base that expires is never folded into, since the result would
+// outlive it: its operands are only combined, and reads apply them
+// to the base for as long as it lasts. Operands newer than a live
+// snapshot are kept as they are.
+
+// MergeOperator combines the operands written with DB.Merge. Set it
+// with Options.MergeOperator. A key's operands may be combined in
+// any grouping, at read time or during compaction, so the operator
+// must be deterministic, and combining two operands with
+// PartialMerge must have the same effect as applying both.
+type MergeOperator interface {
+	// FullMerge applies operands, oldest first, to the existing
+	// value of key, which is nil if the key has none.
+	FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines two consecutive operands of key, older
+	// first, into one. It returns false if they can't be combined
+	// without the existing value.
+	PartialMerge(key string, older, newer []byte) ([]byte, bool)
+}
+
+// errNoMergeOperator is returned when merge operands are written or
+// read without a MergeOperator.
+var errNoMergeOperator = errors.New("no MergeOperator configured")
+
+// Merge records operand for key, to be combined with the key's value
+// by Options.MergeOperator when it is read.
+func (db *DB) Merge(key string, operand []byte) error {
+	return db.MergeWithOptions(key, operand, nil)
+}
+
+// MergeWithOptions is Merge with a per-write sync override.
+func (db *DB) MergeWithOptions(key string, operand []byte, wo *WriteOptions) error {
+	if db.opts.MergeOperator == nil {
+		return fmt.Errorf("db merge: %w", errNoMergeOperator)
+	}
+	return db.write([]WALEntry{{Op: OpMerge, Key: []byte(key), Value: operand}}, false, wo)
+}
+
+// getMerged reads a key whose newest visible version is a merge
+// operand, through an iterator over the sources that may hold the
+// key. The caller must hold db.mu.
+func (db *DB) getMerged(key string, ro *ReadOptions) ([]byte, error) {
+	it := db.newIterator(ro, func(t *tableMeta) bool { return t.contains(key) })
+	defer it.Close()
+	it.Seek(key)
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("db get: %w", err)
+	}
+	if !it.Valid() || it.Key() != key {
+		return nil, ErrKeyNotFound
+	}
+	// The operator may have returned one of its inputs, which can
+	// point into a cached block.
+	return bytes.Clone(it.Value()), nil
+}
+
+// fullMerge resolves a key whose newest visible version is a merge
+// operand. versions holds the key's visible versions, newest first.
+func fullMerge(op MergeOperator, key string, versions []SSTableEntry, now int64, rangeDels *rangeDelIndex) ([]byte, error) {
+	if op == nil {
+		return nil, errNoMergeOperator
+	}
+	var base []byte
+	var operands [][]byte
+	for _, v := range versions {
+		if rangeDels.covers(key, v.Seq) {
+			break
+		}
+		if !v.Merge {
+			if !v.Tombstone && !expired(v.ExpiresAt, now) {
+				base = v.Value
+			}
+			break
+		}
+		operands = append(operands, v.Value)
+	}
+	slices.Reverse(operands)
+	return op.FullMerge(key, base, operands)
+}
+
+// mergeOperands folds the merge operands in entries that every
+// reader at oldest or later sees, as described at the top of this
+// file. entries must be in internal order, with expired values
+// already turned into tombstones; rangeDels indexes the range
+// tombstones every such reader sees. bottom is set when no older
+// version of any key can exist outside entries. Without an operator
+// the entries are returned unchanged.
+func mergeOperands(op MergeOperator, entries []SSTableEntry, rangeDels *rangeDelIndex, oldest uint64, bottom bool) ([]SSTableEntry, error) {
+	if op == nil {
+		return entries, nil
+	}
+	out := entries[:0:0]
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && entries[n].Key == entries[0].Key {
+			n++
+		}
+		versions := entries[:n]
+		entries = entries[n:]
+
+		// Only the versions every reader sees can be folded.
+		i := 0
+		for i < len(versions) && versions[i].Seq > oldest {
+			i++
+		}
+		if i == len(versions) || !versions[i].Merge || rangeDels.covers(versions[i].Key, versions[i].Seq) {
+			out = append(out, versions...)
+			continue
+		}
+		out = append(out, versions[:i]...)
+
+		key := versions[i].Key
+		var operands [][]byte
+		j := i
+		for j < len(versions) && versions[j].Merge && !rangeDels.covers(key, versions[j].Seq) {
+			operands = append(operands, versions[j].Value)
+			j++
+		}
+		slices.Reverse(operands)
+
+		var base *SSTableEntry
+		if j < len(versions) && !versions[j].Tombstone && !rangeDels.covers(key, versions[j].Seq) {
+			base = &versions[j]
+		}
+		if (j < len(versions) || bottom) && (base == nil || base.ExpiresAt == 0) {
+			// The base is here, or there is none to find.
+			var existing []byte
+			if base != nil {
+				existing = base.Value
+			}
+			value, err := op.FullMerge(key, existing, operands)
+			if err != nil {
+				return nil, fmt.Errorf("merge %q: %w", key, err)
+			}
+			// The older versions are now shadowed; dropShadowed
+			// removes them.
+			out = append(out, SSTableEntry{Key: key, Seq: versions[i].Seq, Value: value})
+			out = append(out, versions[j:]...)
+			continue
+		}
+
+		// Combine what PartialMerge allows, oldest first, each result
+		// taking the sequence number of its newest operand.
+		var combined []SSTableEntry
+		for k := j - 1; k >= i; k-- {
+			v := versions[k]
+			if last := len(combined) - 1; last >= 0 {
+				if merged, ok := op.PartialMerge(key, combined[last].Value, v.Value); ok {
+					combined[last] = SSTableEntry{Key: key, Seq: v.Seq, Value: merged, Merge: true}
+					continue
+				}
+			}
+			combined = append(combined, v)
+		}
+		slices.Reverse(combined)
+		out = append(out, combined...)
+		out = append(out, versions[j:]...)
+	}
+	return out, nil
+}
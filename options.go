@@ -0,0 +1,411 @@
+package lsm
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultBloomFPRate is the target false positive rate of the bloom
+// filter written into each SSTable.
+const DefaultBloomFPRate = 0.01
+
+// DefaultBlockSize is the approximate size of an SSTable data block.
+const DefaultBlockSize = 4 * 1024 // 4 KB
+
+// DefaultMaxWALRecordSize caps the size of a single WAL record.
+// Replay treats anything larger as corruption.
+const DefaultMaxWALRecordSize = 64 * 1024 * 1024 // 64 MB
+
+// DefaultMaxImmutableMemtables is how many full memtables may wait
+// for the background flusher before writers stall.
+const DefaultMaxImmutableMemtables = 2
+
+// Leveled compaction defaults. Level 1 may hold DefaultLevelBaseSize
+// bytes and each deeper level DefaultLevelSizeMultiplier times more.
+const (
+	DefaultNumLevels           = 7
+	DefaultLevelBaseSize       = 16 * 1024 * 1024 // 16 MB
+	DefaultLevelSizeMultiplier = 10
+	DefaultTargetFileSize      = 4 * 1024 * 1024 // 4 MB
+)
+
+// DefaultSyncInterval is how often the WAL is fsync'd in the
+// background under SyncInterval.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// SyncMode controls when WAL writes are fsync'd to disk.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the WAL on every write before it returns.
+	// This is the default.
+	SyncAlways SyncMode = iota
+	// SyncNever leaves flushing the WAL to the operating system.
+	// Writes survive a process crash but not a power failure.
+	SyncNever
+	// SyncInterval fsyncs the WAL from a background goroutine every
+	// Options.SyncInterval. A power failure loses at most that much
+	// acknowledged data.
+	SyncInterval
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	case SyncInterval:
+		return "interval"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// Options configures a database opened with OpenWithOptions.
+// Zero-valued fields are replaced with their defaults, so callers
+// only need to set what they want to change.
+type Options struct {
+	// MemtableSize is the approximate number of bytes the memtable
+	// may hold before it is flushed to an SSTable.
+	// Default: DefaultMemtableSize.
+	MemtableSize int
+
+	// MaxImmutableMemtables is how many full memtables may be queued
+	// for the background flusher before writes stall.
+	// Default: DefaultMaxImmutableMemtables.
+	MaxImmutableMemtables int
+
+	// MemtableRep creates the structure each new memtable stores its
+	// entries in. Default: NewSkiplistRep.
+	MemtableRep func() MemtableRep
+
+	// CompactionThreshold is the number of level-0 SSTables that
+	// triggers a compaction. Default: CompactionThreshold.
+	CompactionThreshold int
+
+	// CompactionStrategy decides which SSTables are merged.
+	// Default: LeveledStrategy.
+	CompactionStrategy CompactionStrategy
+
+	// NumLevels is the number of LSM levels, including level 0.
+	// Must be at least 2. Default: DefaultNumLevels.
+	NumLevels int
+
+	// LevelBaseSize is the byte target for level 1.
+	// Default: DefaultLevelBaseSize.
+	LevelBaseSize int64
+
+	// LevelSizeMultiplier is how much larger each level's target is
+	// than the one above it. Default: DefaultLevelSizeMultiplier.
+	LevelSizeMultiplier int
+
+	// TargetFileSize is the approximate size at which compaction
+	// starts a new output SSTable. Default: DefaultTargetFileSize.
+	TargetFileSize int64
+
+	// BlockSize is the approximate size of an SSTable data block. A
+	// point lookup reads and decodes one block. Default: DefaultBlockSize.
+	BlockSize int
+
+	// Compression compresses SSTable blocks. Tables written with any
+	// compressor stay readable after it is changed.
+	// Default: NoCompression.
+	Compression Compressor
+
+	// LevelCompression overrides Compression for individual levels:
+	// tables written to level i use LevelCompression[i] if it is set.
+	// A common choice is no compression for the short-lived upper
+	// levels and a stronger codec for the deepest ones.
+	LevelCompression []Compressor
+
+	// BlockCache caches decoded SSTable blocks. Set it to share one
+	// cache, and one memory budget, between several databases. If
+	// nil, the database creates its own cache of BlockCacheSize bytes.
+	BlockCache *BlockCache
+
+	// BlockCacheSize is the capacity in bytes of the cache created
+	// when BlockCache is nil. Default: DefaultBlockCacheSize.
+	BlockCacheSize int64
+
+	// MaxOpenTables bounds the number of SSTables kept open by the
+	// table cache. Tables beyond it are closed least recently used
+	// first and reopened when next read. Default: DefaultMaxOpenTables.
+	MaxOpenTables int
+
+	// BloomFPRate is the target false positive rate of each SSTable's
+	// bloom filter. Must be between 0 and 1. Default: DefaultBloomFPRate.
+	BloomFPRate float64
+
+	// MaxWALRecordSize is the largest WAL record that will be written
+	// or replayed. Default: DefaultMaxWALRecordSize.
+	MaxWALRecordSize int
+
+	// SyncMode controls when the WAL is fsync'd. Default: SyncAlways.
+	SyncMode SyncMode
+
+	// SyncInterval is the background fsync period used by
+	// SyncInterval mode. Default: DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// WALArchiveDir, if set, is where WAL segments are moved once
+	// their writes are flushed to SSTables, instead of being deleted.
+	// Together with a copy of the SSTables they allow point-in-time
+	// recovery. The directory is created if needed; a relative path
+	// is relative to the working directory. Default: "" (delete).
+	WALArchiveDir string
+
+	// Logger receives diagnostic messages such as skipped corrupt
+	// files. Default: log.Default().
+	Logger *log.Logger
+
+	// FileMode is the permission used for new WAL and SSTable files.
+	// Default: 0644.
+	FileMode os.FileMode
+
+	// DirMode is the permission used when creating the database
+	// directory. Default: 0755.
+	DirMode os.FileMode
+
+	// MergeOperator combines the operands written with DB.Merge. It
+	// is required to call Merge and to read keys that have operands.
+	// Default: nil.
+	MergeOperator MergeOperator
+
+	// Clock returns the current time. It sets and checks the expiry
+	// of values written with PutWithTTL; tests can substitute a fake
+	// clock. Default: time.Now.
+	Clock func() time.Time
+}
+
+// DefaultOptions returns the options used by Open.
+func DefaultOptions() *Options {
+	return &Options{
+		MemtableSize:          DefaultMemtableSize,
+		MaxImmutableMemtables: DefaultMaxImmutableMemtables,
+		MemtableRep:           NewSkiplistRep,
+		CompactionThreshold:   CompactionThreshold,
+		CompactionStrategy:    LeveledStrategy,
+		NumLevels:             DefaultNumLevels,
+		LevelBaseSize:         DefaultLevelBaseSize,
+		LevelSizeMultiplier:   DefaultLevelSizeMultiplier,
+		TargetFileSize:        DefaultTargetFileSize,
+		BlockSize:             DefaultBlockSize,
+		Compression:           NoCompression,
+		BlockCacheSize:        DefaultBlockCacheSize,
+		MaxOpenTables:         DefaultMaxOpenTables,
+		BloomFPRate:           DefaultBloomFPRate,
+		MaxWALRecordSize:      DefaultMaxWALRecordSize,
+		SyncMode:              SyncAlways,
+		SyncInterval:          DefaultSyncInterval,
+		Logger:                log.Default(),
+		FileMode:              0644,
+		DirMode:               0755,
+		Clock:                 time.Now,
+	}
+}
+
+// withDefaults returns a copy of o with zero-valued fields filled
+// in. A nil receiver yields DefaultOptions.
+func (o *Options) withDefaults() *Options {
+	def := DefaultOptions()
+	if o == nil {
+		return def
+	}
+	opts := *o
+	if opts.MemtableSize == 0 {
+		opts.MemtableSize = def.MemtableSize
+	}
+	if opts.MaxImmutableMemtables == 0 {
+		opts.MaxImmutableMemtables = def.MaxImmutableMemtables
+	}
+	if opts.MemtableRep == nil {
+		opts.MemtableRep = def.MemtableRep
+	}
+	if opts.CompactionThreshold == 0 {
+		opts.CompactionThreshold = def.CompactionThreshold
+	}
+	if opts.NumLevels == 0 {
+		opts.NumLevels = def.NumLevels
+	}
+	if opts.LevelBaseSize == 0 {
+		opts.LevelBaseSize = def.LevelBaseSize
+	}
+	if opts.LevelSizeMultiplier == 0 {
+		opts.LevelSizeMultiplier = def.LevelSizeMultiplier
+	}
+	if opts.TargetFileSize == 0 {
+		opts.TargetFileSize = def.TargetFileSize
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = def.BlockSize
+	}
+	if opts.Compression == nil {
+		opts.Compression = def.Compression
+	}
+	if opts.BlockCacheSize == 0 {
+		opts.BlockCacheSize = def.BlockCacheSize
+	}
+	if opts.MaxOpenTables == 0 {
+		opts.MaxOpenTables = def.MaxOpenTables
+	}
+	if opts.BloomFPRate == 0 {
+		opts.BloomFPRate = def.BloomFPRate
+	}
+	if opts.MaxWALRecordSize == 0 {
+		opts.MaxWALRecordSize = def.MaxWALRecordSize
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = def.SyncInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = def.Logger
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = def.FileMode
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = def.DirMode
+	}
+	if opts.Clock == nil {
+		opts.Clock = def.Clock
+	}
+	return &opts
+}
+
+// validate reports the first invalid setting, if any.
+func (o *Options) validate() error {
+	if o.MemtableSize < 0 {
+		return fmt.Errorf("options: MemtableSize must be positive, got %d", o.MemtableSize)
+	}
+	if o.MaxImmutableMemtables < 0 {
+		return fmt.Errorf("options: MaxImmutableMemtables must be positive, got %d", o.MaxImmutableMemtables)
+	}
+	if o.CompactionThreshold < 0 {
+		return fmt.Errorf("options: CompactionThreshold must be positive, got %d", o.CompactionThreshold)
+	}
+	if o.NumLevels < 2 {
+		return fmt.Errorf("options: NumLevels must be at least 2, got %d", o.NumLevels)
+	}
+	if o.LevelBaseSize < 0 {
+		return fmt.Errorf("options: LevelBaseSize must be positive, got %d", o.LevelBaseSize)
+	}
+	if o.LevelSizeMultiplier < 0 {
+		return fmt.Errorf("options: LevelSizeMultiplier must be positive, got %d", o.LevelSizeMultiplier)
+	}
+	if o.TargetFileSize < 0 {
+		return fmt.Errorf("options: TargetFileSize must be positive, got %d", o.TargetFileSize)
+	}
+	if o.BlockSize < 0 {
+		return fmt.Errorf("options: BlockSize must be positive, got %d", o.BlockSize)
+	}
+	if len(o.LevelCompression) > o.NumLevels {
+		return fmt.Errorf("options: LevelCompression has %d entries but NumLevels is %d", len(o.LevelCompression), o.NumLevels)
+	}
+	if err := checkRegistered(o.Compression); err != nil {
+		return fmt.Errorf("options: Compression: %w", err)
+	}
+	for level, c := range o.LevelCompression {
+		if c == nil {
+			continue
+		}
+		if err := checkRegistered(c); err != nil {
+			return fmt.Errorf("options: LevelCompression[%d]: %w", level, err)
+		}
+	}
+	if o.BlockCacheSize < 0 {
+		return fmt.Errorf("options: BlockCacheSize must be positive, got %d", o.BlockCacheSize)
+	}
+	if o.MaxOpenTables < 0 {
+		return fmt.Errorf("options: MaxOpenTables must be positive, got %d", o.MaxOpenTables)
+	}
+	if o.BloomFPRate < 0 || o.BloomFPRate >= 1 {
+		return fmt.Errorf("options: BloomFPRate must be between 0 and 1, got %v", o.BloomFPRate)
+	}
+	if o.MaxWALRecordSize < 0 {
+		return fmt.Errorf("options: MaxWALRecordSize must be positive, got %d", o.MaxWALRecordSize)
+	}
+	switch o.CompactionStrategy {
+	case LeveledStrategy, SizeTieredStrategy, MergeAllStrategy:
+	default:
+		return fmt.Errorf("options: unknown CompactionStrategy %v", o.CompactionStrategy)
+	}
+	switch o.SyncMode {
+	case SyncAlways, SyncNever, SyncInterval:
+	default:
+		return fmt.Errorf("options: unknown SyncMode %v", o.SyncMode)
+	}
+	if o.SyncInterval < 0 {
+		return fmt.Errorf("options: SyncInterval must be positive, got %v", o.SyncInterval)
+	}
+	return nil
+}
+
+// WriteOptions overrides the database's sync policy for a single
+// write. A nil *WriteOptions uses the database default.
+type WriteOptions struct {
+	// Sync fsyncs the WAL before the write returns, even when the
+	// database uses SyncInterval or SyncNever.
+	Sync bool
+
+	// NoSync skips the fsync for this write under SyncAlways. The
+	// write is still logged and will be synced by a later write,
+	// SyncWAL, or the background syncer. Sync takes precedence.
+	NoSync bool
+}
+
+// needsSync reports whether a write with these options must be
+// fsync'd before returning under the given database mode.
+func (wo *WriteOptions) needsSync(mode SyncMode) bool {
+	if wo != nil {
+		if wo.Sync {
+			return true
+		}
+		if wo.NoSync {
+			return false
+		}
+	}
+	return mode == SyncAlways
+}
+
+// ReadOptions adjusts a single read. A nil *ReadOptions uses the
+// defaults.
+type ReadOptions struct {
+	// Snapshot, if set, reads the database as of when the snapshot
+	// was taken instead of its current state.
+	Snapshot *Snapshot
+
+	// VerifyChecksums checks the checksum of every SSTable block the
+	// read loads from disk. Blocks already in the block cache are not
+	// checked again. Compactions always verify what they read.
+	VerifyChecksums bool
+}
+
+func (ro *ReadOptions) verifyChecksums() bool {
+	return ro != nil && ro.VerifyChecksums
+}
+
+// tableOptions returns the settings used when writing SSTables to
+// the given level.
+func (o *Options) tableOptions(level int) tableOptions {
+	compressor := o.Compression
+	if level < len(o.LevelCompression) && o.LevelCompression[level] != nil {
+		compressor = o.LevelCompression[level]
+	}
+	return tableOptions{
+		blockSize:   o.BlockSize,
+		compressor:  compressor,
+		bloomFPRate: o.BloomFPRate,
+		perm:        o.FileMode,
+	}
+}
+
+// walOptions returns the settings used when opening the WAL.
+func (o *Options) walOptions() walOptions {
+	return walOptions{
+		maxRecordSize: o.MaxWALRecordSize,
+		syncMode:      o.SyncMode,
+		perm:          o.FileMode,
+	}
+}
@@ -0,0 +1,169 @@
+package lsm
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Range deletion
+//
+// DeleteRange writes a single range tombstone instead of a tombstone
+// per key. A range tombstone [start, end) with sequence number s
+// deletes every version of every key in the range with a sequence
+// number below s; writes after it are unaffected. Like any write it
+// is only visible to readers at s or later.
+//
+// The memtable keeps its range tombstones in a skiplist of their own,
+// keyed by start key with the end key as the value, and an SSTable
+// stores them in a dedicated block (see sstable.go). Because every
+// source a read consults holds only versions older than those of the
+// sources before it, a source can resolve a key on its own: a point
+// version there is visible unless one of the source's own range
+// tombstones is newer. Iterators instead merge the visible range
+// tombstones of every source up front.
+//
+// A table's key range covers its range tombstones as well as its
+// keys, so compaction picks up the tables they may delete from.
+// Compaction drops the versions a tombstone covers once no snapshot
+// can still see them, and drops the tombstone itself under the same
+// rules as a point tombstone.
+
+// rangeTombstone deletes the versions of keys in [start, end) older
+// than seq.
+type rangeTombstone struct {
+	start string
+	end   string
+	seq   uint64
+}
+
+// compareRangeTombstones orders tombstones by start key, newest
+// first, the order they are stored in.
+func compareRangeTombstones(a, b rangeTombstone) int {
+	return compareInternal(a.start, a.seq, b.start, b.seq)
+}
+
+// coveringSeq returns the highest sequence number <= seq of the
+// tombstones in tombs that contain key, or 0 if none does. tombs
+// must be sorted by start key.
+func coveringSeq(tombs []rangeTombstone, key string, seq uint64) uint64 {
+	var newest uint64
+	for _, t := range tombs {
+		if t.start > key {
+			break
+		}
+		if key < t.end && t.seq <= seq && t.seq > newest {
+			newest = t.seq
+		}
+	}
+	return newest
+}
+
+// rangeDelIndex answers coverage queries against many range
+// tombstones. The key space is cut into fragments at every start
+// and end key, and each fragment records the newest tombstone over
+// it, so a lookup is one binary search.
+type rangeDelIndex struct {
+	bounds []string // fragment i is [bounds[i], bounds[i+1])
+	seqs   []uint64 // newest tombstone over each fragment; 0 for none
+}
+
+// newRangeDelIndex indexes the tombstones with a sequence number
+// <= seq.
+func newRangeDelIndex(tombs []rangeTombstone, seq uint64) *rangeDelIndex {
+	idx := &rangeDelIndex{}
+	for _, t := range tombs {
+		if t.seq <= seq {
+			idx.bounds = append(idx.bounds, t.start, t.end)
+		}
+	}
+	if len(idx.bounds) == 0 {
+		return idx
+	}
+	slices.Sort(idx.bounds)
+	idx.bounds = slices.Compact(idx.bounds)
+	idx.seqs = make([]uint64, len(idx.bounds)-1)
+	for _, t := range tombs {
+		if t.seq > seq {
+			continue
+		}
+		i, _ := slices.BinarySearch(idx.bounds, t.start)
+		for ; i < len(idx.seqs) && idx.bounds[i] < t.end; i++ {
+			idx.seqs[i] = max(idx.seqs[i], t.seq)
+		}
+	}
+	return idx
+}
+
+// covers reports whether an indexed tombstone deletes version seq of
+// key.
+func (idx *rangeDelIndex) covers(key string, seq uint64) bool {
+	i := sort.SearchStrings(idx.bounds, key)
+	if i == len(idx.bounds) || idx.bounds[i] != key {
+		i-- // key falls inside the fragment starting before it
+	}
+	return i >= 0 && i < len(idx.seqs) && idx.seqs[i] > seq
+}
+
+// dropCovered removes the versions in entries that a tombstone
+// visible to every reader at oldest or later deletes. Tombstones
+// visible to every such reader are dropped as well when
+// dropTombstones is set, which is only safe when no older data
+// outside entries could hold their keys. It returns the remaining
+// tombstones in storage order.
+func dropCovered(entries []SSTableEntry, tombs []rangeTombstone, oldest uint64, dropTombstones bool) ([]SSTableEntry, []rangeTombstone) {
+	if len(tombs) == 0 {
+		return entries, nil
+	}
+	idx := newRangeDelIndex(tombs, oldest)
+	live := entries[:0:0]
+	for _, e := range entries {
+		if !idx.covers(e.Key, e.Seq) {
+			live = append(live, e)
+		}
+	}
+	var kept []rangeTombstone
+	for _, t := range tombs {
+		if !dropTombstones || t.seq > oldest {
+			kept = append(kept, t)
+		}
+	}
+	slices.SortFunc(kept, compareRangeTombstones)
+	return live, kept
+}
+
+// DeleteRange deletes every key in [start, end) with a single range
+// tombstone. Keys written after it returns are unaffected. An empty
+// range is a no-op.
+func (db *DB) DeleteRange(start, end string) error {
+	return db.DeleteRangeWithOptions(start, end, nil)
+}
+
+// DeleteRangeWithOptions is DeleteRange with a per-write sync
+// override.
+func (db *DB) DeleteRangeWithOptions(start, end string, wo *WriteOptions) error {
+	if start >= end {
+		return nil
+	}
+	return db.write([]WALEntry{{Op: OpDeleteRange, Key: []byte(start), Value: []byte(end)}}, false, wo)
+}
+
+// decodeRangeTombstones parses the range tombstone block of an
+// SSTable.
+func decodeRangeTombstones(block []byte) ([]rangeTombstone, error) {
+	bi, err := newBlockIter(block, true)
+	if err != nil {
+		return nil, err
+	}
+	var tombs []rangeTombstone
+	for bi.first(); bi.valid; bi.advance() {
+		if bi.kind != kindRangeDelete {
+			return nil, fmt.Errorf("%w: unexpected entry kind %d", errCorruptBlock, bi.kind)
+		}
+		tombs = append(tombs, rangeTombstone{start: string(bi.key), end: string(bi.value), seq: bi.seq})
+	}
+	if bi.err != nil {
+		return nil, bi.err
+	}
+	return tombs, nil
+}
@@ -0,0 +1,161 @@
+package lsm
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Skiplist
+//
+// The default MemtableRep is a skiplist: a sorted linked list where
+// each node also appears in a random number of higher "express"
+// lists, each about a quarter as long as the one below. A search
+// walks the highest list until the next key is too large, then drops
+// a level, so lookups and inserts take O(log n) instead of the O(n)
+// shift a sorted slice needs per insert.
+//
+// Each node holds one version of a key, ordered by key and then
+// newest first, so a newer write adds a node in front of the older
+// versions rather than changing one. Nodes are never modified or
+// removed once linked, and every link is an atomic pointer. The
+// writer fully builds a node before linking it in, bottom level
+// first, so a reader walking the list at the same time sees either
+// the old list or the new one and never needs a lock.
+//
+// Nodes, keys, and values live in the skiplist's arena (see arena.go).
+
+const (
+	skiplistMaxHeight = 12
+	skiplistBranching = 4
+)
+
+type skiplist struct {
+	head   skipNode
+	height atomic.Int32 // levels in use; at least 1
+	n      atomic.Int64
+	size   atomic.Int64 // arena bytes in use, published after each Put
+	arena  arena        // writer only
+}
+
+type skipNode struct {
+	key       []byte // in the arena
+	seq       uint64
+	kind      EntryKind
+	value     []byte // in the arena
+	expiresAt int64
+	next      []skipLink // one link per level of the node
+}
+
+type skipLink = atomic.Pointer[skipNode]
+
+// NewSkiplistRep returns an empty skiplist MemtableRep.
+func NewSkiplistRep() MemtableRep {
+	s := &skiplist{}
+	s.head.next = make([]skipLink, skiplistMaxHeight)
+	s.height.Store(1)
+	return s
+}
+
+// randomHeight picks a node height, each level a quarter as likely
+// as the one below.
+func randomHeight() int {
+	h := 1
+	for h < skiplistMaxHeight && rand.IntN(skiplistBranching) == 0 {
+		h++
+	}
+	return h
+}
+
+// findGE returns the first node at or after version seq of key in
+// internal order, or nil. If prev is non-nil it is filled with the
+// last node before that position at each level, which is where a new
+// node for it would be linked in.
+func (s *skiplist) findGE(key string, seq uint64, prev *[skiplistMaxHeight]*skipNode) *skipNode {
+	x := &s.head
+	for level := int(s.height.Load()) - 1; ; level-- {
+		next := x.next[level].Load()
+		for next != nil && compareInternal(string(next.key), next.seq, key, seq) < 0 {
+			x = next
+			next = x.next[level].Load()
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+}
+
+func (s *skiplist) Add(key string, seq uint64, value []byte, kind EntryKind, expiresAt int64) {
+	var prev [skiplistMaxHeight]*skipNode
+	s.findGE(key, seq, &prev)
+
+	h := randomHeight()
+	if cur := int(s.height.Load()); h > cur {
+		for level := cur; level < h; level++ {
+			prev[level] = &s.head
+		}
+		// A reader that sees the new height before the node is
+		// linked finds empty lists up there and drops down.
+		s.height.Store(int32(h))
+	}
+	node := s.arena.newNode()
+	node.key = arenaCopy(&s.arena, key)
+	node.seq = seq
+	node.kind = kind
+	if kind != KindTombstone {
+		node.value = arenaCopy(&s.arena, value)
+		node.expiresAt = expiresAt
+	}
+	node.next = s.arena.newLinks(h)
+	for level := 0; level < h; level++ {
+		node.next[level].Store(prev[level].next[level].Load())
+	}
+	for level := 0; level < h; level++ {
+		prev[level].next[level].Store(node)
+	}
+	s.n.Add(1)
+	s.size.Store(s.arena.used)
+}
+
+func (s *skiplist) Get(key string, seq uint64) ([]byte, int64, EntryKind, bool) {
+	x := s.findGE(key, seq, nil)
+	if x == nil || string(x.key) != key {
+		return nil, 0, 0, false
+	}
+	return x.value, x.expiresAt, x.kind, true
+}
+
+func (s *skiplist) Len() int {
+	return int(s.n.Load())
+}
+
+func (s *skiplist) Size() int {
+	return int(s.size.Load())
+}
+
+func (s *skiplist) NewIterator() MemtableIterator {
+	return &skiplistIterator{list: s}
+}
+
+// skiplistIterator walks the bottom level of a skiplist.
+type skiplistIterator struct {
+	list *skiplist
+	node *skipNode
+}
+
+func (it *skiplistIterator) Seek(key string) {
+	it.node = it.list.findGE(key, maxSeqNum, nil)
+}
+
+func (it *skiplistIterator) Next() {
+	it.node = it.node.next[0].Load()
+}
+
+func (it *skiplistIterator) Valid() bool      { return it.node != nil }
+func (it *skiplistIterator) Key() string      { return string(it.node.key) }
+func (it *skiplistIterator) Seq() uint64      { return it.node.seq }
+func (it *skiplistIterator) Value() []byte    { return it.node.value }
+func (it *skiplistIterator) ExpiresAt() int64 { return it.node.expiresAt }
+func (it *skiplistIterator) Kind() EntryKind  { return it.node.kind }
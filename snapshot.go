@@ -0,0 +1,121 @@
+package lsm
+
+import (
+	"container/list"
+	"math"
+)
+
+// Sequence numbers and snapshots
+//
+// Every write is stamped with a sequence number, one higher than the
+// write before it, and carries it through the WAL, the memtable, and
+// SSTables. A key may therefore have several versions, ordered newest
+// first by sequence number; nothing is overwritten in place. A read
+// at sequence number s sees, for each key, the newest version with a
+// sequence number <= s, so it is unaffected by later writes.
+//
+// Writes become visible by advancing the database's last sequence
+// number once they are in the memtable; a batch is published with a
+// single advance, so readers see all of it or none. A Snapshot pins
+// a sequence number for later reads. Flushes and compactions drop a
+// version only once a newer version of the same key is visible to
+// every live snapshot.
+//
+// Data written before sequence numbers existed has sequence number 0,
+// older than anything written since.
+
+// maxSeqNum reads the newest version of every key.
+const maxSeqNum = math.MaxUint64
+
+// Snapshot is a consistent read-only view of the database as of the
+// moment it was taken. Pass it in ReadOptions to read through it.
+// A snapshot keeps the versions it can see from being compacted
+// away, so release it when done.
+type Snapshot struct {
+	db   *DB
+	seq  uint64
+	elem *list.Element // in db.snapshots; nil once released
+}
+
+// GetSnapshot returns a snapshot of the current state of the
+// database. The caller must call Release when done with it.
+func (db *DB) GetSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := &Snapshot{db: db, seq: db.lastSeqNum.Load()}
+	s.elem = db.snapshots.PushBack(s)
+	return s
+}
+
+// Release lets compaction reclaim the versions the snapshot was
+// holding on to. Releasing a snapshot more than once is a no-op.
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.elem != nil {
+		s.db.snapshots.Remove(s.elem)
+		s.elem = nil
+	}
+}
+
+// readSeq returns the sequence number a read with these options sees.
+func (ro *ReadOptions) readSeq(db *DB) uint64 {
+	if ro != nil && ro.Snapshot != nil {
+		return ro.Snapshot.seq
+	}
+	return db.lastSeqNum.Load()
+}
+
+// oldestSnapshot returns the smallest sequence number any reader may
+// still read at: the oldest live snapshot, or the last sequence
+// number if there is none. Snapshots are taken in order, so the
+// oldest is at the front. The caller must hold db.mu.
+func (db *DB) oldestSnapshot() uint64 {
+	if front := db.snapshots.Front(); front != nil {
+		return front.Value.(*Snapshot).seq
+	}
+	return db.lastSeqNum.Load()
+}
+
+// compareInternal orders versions by key, then newest first.
+func compareInternal(key1 string, seq1 uint64, key2 string, seq2 uint64) int {
+	switch {
+	case key1 < key2:
+		return -1
+	case key1 > key2:
+		return 1
+	case seq1 > seq2:
+		return -1
+	case seq1 < seq2:
+		return 1
+	}
+	return 0
+}
+
+// dropShadowed removes versions that no reader at oldest or later
+// can see: every version of a key after the first one whose sequence
+// number is <= oldest, not counting merge operands, which still need
+// the versions below them. entries must be in internal order.
+// Tombstones visible to every reader are dropped as well when
+// dropTombstones is set, which is only safe when no older data
+// outside entries could hold their keys.
+func dropShadowed(entries []SSTableEntry, oldest uint64, dropTombstones bool) []SSTableEntry {
+	live := entries[:0:0]
+	shadowed := false // a version visible to every reader was seen
+	for i, e := range entries {
+		if i == 0 || e.Key != entries[i-1].Key {
+			shadowed = false
+		}
+		if shadowed {
+			continue
+		}
+		if e.Seq <= oldest && !e.Merge {
+			shadowed = true
+			if e.Tombstone && dropTombstones {
+				continue
+			}
+		}
+		live = append(live, e)
+	}
+	return live
+}
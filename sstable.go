@@ -3,95 +3,213 @@ package lsm
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 )
 
-// SSTable on-disk format:
+// SSTable on-disk format (v8):
+//
+//	[data block...][index block][range tombstone block][bloom filter bytes][bloom crc32(4)][footer]
+//
+// Data and index blocks are described in block.go. Each is stored
+// followed by a one-byte compressor ID (see compression.go) and a
+// CRC32 of the stored bytes and ID, and block handles cover the
+// stored bytes including both. The index block holds one entry per
+// data block, mapping the block's last key and sequence number to its
+// handle: [offset uvarint][size uvarint]. The bloom filter holds user
+// keys and is followed by a CRC32 of its bytes, and bloom_size
+// includes it. The range tombstone block is stored like the others
+// and holds the table's range tombstones (see rangedel.go).
+//
+// Footer: [index_offset(8)][index_size(4)][bloom_offset(8)][bloom_size(4)][rangedel_offset(8)][rangedel_size(4)][version(4)][magic(4)]
+//
+// v7 is the same without merge operands (see block.go). v6 also
+// lacks expiring values. v5 also lacks the range tombstone block,
+// and its footer ends at bloom_size before the version. v4 also has
+// no sequence numbers in its blocks: every entry has sequence number
+// 0 and each key appears once. v3 also lacks the checksums. v2 also
+// lacks the compressor ID; those blocks are never compressed.
+//
+// Magic number: 0x4C534D32 ("LSM2"). The version, always just before
+// the magic, lets later formats extend the footer; readers reject
+// versions they don't know.
+//
+// v1 files, which have a 28-byte footer ending in magic 0x4C534D54
+// ("LSMT"), are still read:
 //
 //	[data entries...][index entries...][bloom filter bytes][footer]
 //
 // Data entry:  [key_len(4)][key][value_len(4)][value][tombstone(1)]
 // Index entry: [key_len(4)][key][offset(8)]
 // Footer:      [index_offset(8)][index_count(4)][bloom_offset(8)][bloom_size(4)][magic(4)]
-//
-// Magic number: 0x4C534D54 ("LSMT")
-const sstMagic uint32 = 0x4C534D54
-const footerSize = 8 + 4 + 8 + 4 + 4 // 28 bytes
+const (
+	sstMagic     uint32 = 0x4C534D32
+	sstVersion   uint32 = 8
+	footerSize          = 8 + 4 + 8 + 4 + 8 + 4 + 4 + 4 // 44 bytes
+	footerSizeV2        = 8 + 4 + 8 + 4 + 4 + 4         // 32 bytes, v2 to v5
+	sstMagicV1   uint32 = 0x4C534D54
+	footerSizeV1        = 8 + 4 + 8 + 4 + 4 // 28 bytes
+)
+
+// blockTrailerSize is the size of the checksum that follows each
+// block and the bloom filter in a v4 or later table.
+const blockTrailerSize = 4
+
+// tmpSuffix marks a file that is still being written. Files are
+// renamed to their final name only once complete and fsync'd.
+const tmpSuffix = ".tmp"
 
-// SSTableEntry represents a key-value pair written to an SSTable.
+// SSTableEntry represents a version of a key written to an SSTable.
 type SSTableEntry struct {
 	Key       string
+	Seq       uint64 // sequence number of the write (see snapshot.go)
 	Value     []byte
+	ExpiresAt int64 // expiry in Unix nanoseconds; 0 if none (see ttl.go)
 	Tombstone bool
+	Merge     bool // Value is a merge operand (see merge.go)
 }
 
-// indexEntry maps a key to its byte offset in the data section.
+// indexEntry maps a key to its byte offset in the data section of a
+// v1 SSTable.
 type indexEntry struct {
 	Key    string
 	Offset int64
 }
 
-// WriteSSTable writes a sorted slice of entries to an SSTable file.
-// The caller must ensure entries are sorted by key.
+// tableOptions holds the SSTable write settings derived from Options.
+type tableOptions struct {
+	blockSize   int
+	compressor  Compressor
+	bloomFPRate float64
+	perm        os.FileMode
+}
+
+// defaultTableOptions returns the settings used by WriteSSTable.
+func defaultTableOptions() tableOptions {
+	return DefaultOptions().tableOptions(0)
+}
+
+// WriteSSTable writes a sorted slice of entries to an SSTable file
+// using the default options. The caller must ensure entries are
+// sorted by key, with the versions of a key newest first. The file
+// appears at path only once it is complete and durable.
 func WriteSSTable(path string, entries []SSTableEntry) error {
-	f, err := os.Create(path)
+	return writeSSTable(path, entries, nil, defaultTableOptions())
+}
+
+// writeSSTable writes the table under a temporary name, fsyncs it,
+// and renames it into place, then fsyncs the directory. A crash
+// therefore never leaves a partial file under an SSTable name; at
+// worst it leaves a .tmp file for the next Open to delete.
+func writeSSTable(path string, entries []SSTableEntry, rangeDels []rangeTombstone, opts tableOptions) error {
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, opts.perm)
 	if err != nil {
 		return fmt.Errorf("sstable create: %w", err)
 	}
-	defer f.Close()
+	if err := writeTable(f, entries, rangeDels, opts); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("sstable sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sstable close: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sstable rename: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
 
+// writeTable writes the data blocks, index block, range tombstone
+// block, bloom filter, and footer to f. rangeDels must be sorted by
+// start key, newest first.
+func writeTable(f *os.File, entries []SSTableEntry, rangeDels []rangeTombstone, opts tableOptions) error {
 	// Build bloom filter from keys
-	bloom := NewBloomFilter(len(entries), 0.01)
+	bloom := NewBloomFilter(len(entries), opts.bloomFPRate)
 	for _, e := range entries {
 		bloom.Add([]byte(e.Key))
 	}
 
-	// Write data entries, collecting index as we go
-	var index []indexEntry
+	// Write data blocks, indexing each by its last key
+	var data, index blockBuilder
 	offset := int64(0)
-
-	for _, e := range entries {
-		index = append(index, indexEntry{Key: e.Key, Offset: offset})
-
-		keyBytes := []byte(e.Key)
-		entrySize := 4 + len(keyBytes) + 4 + len(e.Value) + 1
-		buf := make([]byte, entrySize)
-
-		off := 0
-		binary.LittleEndian.PutUint32(buf[off:], uint32(len(keyBytes)))
-		off += 4
-		copy(buf[off:], keyBytes)
-		off += len(keyBytes)
-		binary.LittleEndian.PutUint32(buf[off:], uint32(len(e.Value)))
-		off += 4
-		copy(buf[off:], e.Value)
-		off += len(e.Value)
-		if e.Tombstone {
-			buf[off] = 1
+	writeBlock := func(b *blockBuilder) (blockHandle, error) {
+		block, err := compressBlock(b.finish(), opts.compressor)
+		if err != nil {
+			return blockHandle{}, err
 		}
-
-		if _, err := f.Write(buf); err != nil {
+		block = appendChecksum(block)
+		if _, err := f.Write(block); err != nil {
+			return blockHandle{}, err
+		}
+		h := blockHandle{offset: offset, size: int64(len(block))}
+		offset += h.size
+		return h, nil
+	}
+	flushData := func() error {
+		lastKey, lastSeq := string(data.lastKey), data.lastSeq
+		h, err := writeBlock(&data)
+		if err != nil {
 			return fmt.Errorf("sstable write data: %w", err)
 		}
-		offset += int64(entrySize)
+		index.add(lastKey, lastSeq, h.encode(), kindValue)
+		data.reset()
+		return nil
 	}
 
-	// Write index entries
-	indexOffset := offset
-	for _, idx := range index {
-		keyBytes := []byte(idx.Key)
-		buf := make([]byte, 4+len(keyBytes)+8)
-		binary.LittleEndian.PutUint32(buf[0:4], uint32(len(keyBytes)))
-		copy(buf[4:], keyBytes)
-		binary.LittleEndian.PutUint64(buf[4+len(keyBytes):], uint64(idx.Offset))
-		if _, err := f.Write(buf); err != nil {
-			return fmt.Errorf("sstable write index: %w", err)
+	for _, e := range entries {
+		kind, value := kindValue, e.Value
+		switch {
+		case e.Tombstone:
+			kind = kindTombstone
+		case e.Merge:
+			kind = kindMerge
+		case e.ExpiresAt != 0:
+			kind = kindExpiringValue
+			value = binary.LittleEndian.AppendUint64(nil, uint64(e.ExpiresAt))
+			value = append(value, e.Value...)
+		}
+		data.add(e.Key, e.Seq, value, kind)
+		if data.estimatedSize() >= opts.blockSize {
+			if err := flushData(); err != nil {
+				return err
+			}
+		}
+	}
+	if data.entries > 0 {
+		if err := flushData(); err != nil {
+			return err
 		}
-		offset += int64(len(buf))
+	}
+
+	// Write index block
+	indexHandle, err := writeBlock(&index)
+	if err != nil {
+		return fmt.Errorf("sstable write index: %w", err)
+	}
+
+	// Write range tombstone block, keyed by start key with the end
+	// key as the value
+	var rangeDelBlock blockBuilder
+	for _, t := range rangeDels {
+		rangeDelBlock.add(t.start, t.seq, []byte(t.end), kindRangeDelete)
+	}
+	rangeDelHandle, err := writeBlock(&rangeDelBlock)
+	if err != nil {
+		return fmt.Errorf("sstable write range tombstones: %w", err)
 	}
 
 	// Write bloom filter
-	bloomBytes := bloom.Serialize()
+	bloomBytes := appendChecksum(bloom.Serialize())
 	bloomOffset := offset
 	if _, err := f.Write(bloomBytes); err != nil {
 		return fmt.Errorf("sstable write bloom: %w", err)
@@ -99,14 +217,21 @@ func WriteSSTable(path string, entries []SSTableEntry) error {
 
 	// Write footer
 	footer := make([]byte, footerSize)
-	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
-	binary.LittleEndian.PutUint32(footer[8:12], uint32(len(index)))
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexHandle.offset))
+	binary.LittleEndian.PutUint32(footer[8:12], uint32(indexHandle.size))
 	binary.LittleEndian.PutUint64(footer[12:20], uint64(bloomOffset))
 	binary.LittleEndian.PutUint32(footer[20:24], uint32(len(bloomBytes)))
-	binary.LittleEndian.PutUint32(footer[24:28], sstMagic)
+	binary.LittleEndian.PutUint64(footer[24:32], uint64(rangeDelHandle.offset))
+	binary.LittleEndian.PutUint32(footer[32:36], uint32(rangeDelHandle.size))
+	binary.LittleEndian.PutUint32(footer[36:40], sstVersion)
+	binary.LittleEndian.PutUint32(footer[40:44], sstMagic)
 	if _, err := f.Write(footer); err != nil {
 		return fmt.Errorf("sstable write footer: %w", err)
 	}
+	return nil
+}
 
-	return f.Sync()
+// appendChecksum appends the CRC32 of b to it.
+func appendChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
 }
@@ -3,17 +3,57 @@ package lsm
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // SSTableReader provides read access to an SSTable file on disk.
-// It loads the index and bloom filter into memory on open, then
-// uses binary search and random reads to serve point lookups.
+// It loads the block index and bloom filter into memory on open,
+// then serves point lookups by binary-searching the index and
+// decoding a single data block. v1 files, which index every key,
+// are read through their per-key index instead.
+//
+// The index and bloom filter of a v4 or later table are checked
+// against their checksums on open. Data blocks are checked when read
+// from disk if the caller asks; a block served from the block cache
+// was decoded once already and is not checked again. Lookup and
+// ReadAll report damage as an error wrapping ErrCorruption.
+//
+// Readers are reference counted: the opener holds one reference and
+// each Get, iterator, or compaction using it takes its own, so a
+// reader evicted from the table cache or dropped by compaction stays
+// readable until its last user is done.
 type SSTableReader struct {
-	file  *os.File
-	index []indexEntry
-	bloom *BloomFilter
+	path     string
+	size     int64
+	file     *os.File
+	version  uint32
+	blocks   []blockIndexEntry // v2: one entry per data block
+	index    []indexEntry      // v1: one entry per key
+	dataEnd  int64             // v1: end of the data entries
+	smallest string            // smallest key or range tombstone start
+	largest  string            // largest key or range tombstone end
+	bloom    *BloomFilter
+
+	// rangeDels holds the range tombstones of a v6 table, sorted by
+	// start key, newest first.
+	rangeDels []rangeTombstone
+	refs      atomic.Int32
+
+	// cache holds decoded data blocks under cacheKey with the block's
+	// offset filled in. It is nil for readers opened outside a DB.
+	cache    *BlockCache
+	cacheKey blockCacheKey
+}
+
+// blockIndexEntry maps the last entry of a data block to the block.
+type blockIndexEntry struct {
+	lastKey string
+	lastSeq uint64
+	handle  blockHandle
 }
 
 // OpenSSTable opens an SSTable file and loads its index and bloom filter.
@@ -23,131 +63,495 @@ func OpenSSTable(path string) (*SSTableReader, error) {
 		return nil, fmt.Errorf("sstable open: %w", err)
 	}
 
-	// Read footer from end of file
 	info, err := f.Stat()
 	if err != nil {
 		f.Close()
 		return nil, fmt.Errorf("sstable stat: %w", err)
 	}
-	if info.Size() < int64(footerSize) {
+	r := &SSTableReader{path: path, size: info.Size(), file: f}
+	if err := r.load(); err != nil {
 		f.Close()
-		return nil, fmt.Errorf("sstable too small")
+		return nil, err
 	}
+	r.refs.Store(1)
+	return r, nil
+}
 
-	footer := make([]byte, footerSize)
-	if _, err := f.ReadAt(footer, info.Size()-int64(footerSize)); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("sstable read footer: %w", err)
+// load reads the footer from the end of the file and loads the
+// index and bloom filter for the format it names.
+func (r *SSTableReader) load() error {
+	if r.size < 4 {
+		return fmt.Errorf("%w: sstable too small", ErrCorruption)
+	}
+	tail := make([]byte, 4)
+	if _, err := r.file.ReadAt(tail, r.size-4); err != nil {
+		return fmt.Errorf("sstable read footer: %w", err)
+	}
+	switch magic := binary.LittleEndian.Uint32(tail); magic {
+	case sstMagic:
+		return r.loadV2()
+	case sstMagicV1:
+		return r.loadV1()
+	default:
+		return fmt.Errorf("%w: sstable bad magic: %x", ErrCorruption, magic)
 	}
+}
 
-	magic := binary.LittleEndian.Uint32(footer[24:28])
-	if magic != sstMagic {
-		f.Close()
-		return nil, fmt.Errorf("sstable bad magic: %x", magic)
+// loadV2 loads a block-based table.
+func (r *SSTableReader) loadV2() error {
+	if r.size < 8 {
+		return fmt.Errorf("%w: sstable too small", ErrCorruption)
+	}
+	tail := make([]byte, 4)
+	if _, err := r.file.ReadAt(tail, r.size-8); err != nil {
+		return fmt.Errorf("sstable read footer: %w", err)
+	}
+	r.version = binary.LittleEndian.Uint32(tail)
+	if r.version < 2 || r.version > sstVersion {
+		return fmt.Errorf("sstable unsupported version %d", r.version)
+	}
+	size := footerSizeV2
+	if r.version >= 6 {
+		size = footerSize
+	}
+	if r.size < int64(size) {
+		return fmt.Errorf("%w: sstable too small", ErrCorruption)
+	}
+	footer := make([]byte, size)
+	if _, err := r.file.ReadAt(footer, r.size-int64(size)); err != nil {
+		return fmt.Errorf("sstable read footer: %w", err)
+	}
+
+	indexHandle := blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(footer[0:8])),
+		size:   int64(binary.LittleEndian.Uint32(footer[8:12])),
+	}
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[12:20]))
+	bloomSize := int64(binary.LittleEndian.Uint32(footer[20:24]))
+	rangeDelHandle := blockHandle{offset: indexHandle.offset + indexHandle.size}
+	if r.version >= 6 {
+		rangeDelHandle.offset = int64(binary.LittleEndian.Uint64(footer[24:32]))
+		rangeDelHandle.size = int64(binary.LittleEndian.Uint32(footer[32:36]))
+	}
+	dataEnd := r.size - int64(size)
+	if indexHandle.offset+indexHandle.size > rangeDelHandle.offset ||
+		rangeDelHandle.offset+rangeDelHandle.size > bloomOffset || bloomOffset+bloomSize > dataEnd {
+		return fmt.Errorf("%w: sstable footer out of range", ErrCorruption)
+	}
+
+	// Load bloom filter
+	bloomData := make([]byte, bloomSize)
+	if _, err := r.file.ReadAt(bloomData, bloomOffset); err != nil {
+		return fmt.Errorf("sstable read bloom: %w", err)
+	}
+	if r.version >= 4 {
+		var err error
+		if bloomData, err = r.checkSum(bloomData, bloomOffset, true); err != nil {
+			return fmt.Errorf("sstable read bloom: %w", err)
+		}
+	}
+	r.bloom = DeserializeBloom(bloomData)
+
+	// Load index
+	indexBlock, err := r.readBlock(indexHandle, true)
+	if err != nil {
+		return fmt.Errorf("sstable read index: %w", err)
+	}
+	bi, err := newBlockIter(indexBlock, r.version >= 5)
+	if err != nil {
+		return fmt.Errorf("sstable read index: %w", err)
+	}
+	for bi.first(); bi.valid; bi.advance() {
+		h, err := decodeBlockHandle(bi.value)
+		if err != nil {
+			return fmt.Errorf("sstable read index: %w", err)
+		}
+		if h.offset+h.size > indexHandle.offset {
+			return fmt.Errorf("%w: sstable read index: block out of range", ErrCorruption)
+		}
+		r.blocks = append(r.blocks, blockIndexEntry{lastKey: string(bi.key), lastSeq: bi.seq, handle: h})
+	}
+	if bi.err != nil {
+		return fmt.Errorf("sstable read index: %w", bi.err)
+	}
+
+	// The index only holds last keys, so the smallest key comes from
+	// the first data block.
+	if len(r.blocks) > 0 {
+		r.largest = r.blocks[len(r.blocks)-1].lastKey
+		first, err := r.openBlock(0, true)
+		if err != nil {
+			return fmt.Errorf("sstable read first block: %w", err)
+		}
+		first.first()
+		if !first.valid {
+			return fmt.Errorf("sstable read first block: %w", errCorruptBlock)
+		}
+		r.smallest = string(first.key)
+	}
+
+	// Range tombstones widen the key range to everything they cover.
+	if r.version >= 6 {
+		block, err := r.readBlock(rangeDelHandle, true)
+		if err != nil {
+			return fmt.Errorf("sstable read range tombstones: %w", err)
+		}
+		if r.rangeDels, err = decodeRangeTombstones(block); err != nil {
+			return fmt.Errorf("sstable read range tombstones: %w", err)
+		}
+		for i, t := range r.rangeDels {
+			if (i == 0 && len(r.blocks) == 0) || t.start < r.smallest {
+				r.smallest = t.start
+			}
+			if (i == 0 && len(r.blocks) == 0) || t.end > r.largest {
+				r.largest = t.end
+			}
+		}
 	}
+	return nil
+}
+
+// loadV1 loads a table in the original per-key-index format.
+func (r *SSTableReader) loadV1() error {
+	if r.size < int64(footerSizeV1) {
+		return fmt.Errorf("%w: sstable too small", ErrCorruption)
+	}
+	footer := make([]byte, footerSizeV1)
+	if _, err := r.file.ReadAt(footer, r.size-int64(footerSizeV1)); err != nil {
+		return fmt.Errorf("sstable read footer: %w", err)
+	}
+	r.version = 1
 
 	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
 	indexCount := binary.LittleEndian.Uint32(footer[8:12])
 	bloomOffset := int64(binary.LittleEndian.Uint64(footer[12:20]))
 	bloomSize := binary.LittleEndian.Uint32(footer[20:24])
+	if indexOffset < 0 || indexOffset > bloomOffset || bloomOffset+int64(bloomSize) > r.size-int64(footerSizeV1) {
+		return r.corruption(r.size-int64(footerSizeV1), "footer out of range")
+	}
+	r.dataEnd = indexOffset
 
 	// Load bloom filter
 	bloomData := make([]byte, bloomSize)
-	if _, err := f.ReadAt(bloomData, bloomOffset); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("sstable read bloom: %w", err)
+	if _, err := r.file.ReadAt(bloomData, bloomOffset); err != nil {
+		return fmt.Errorf("sstable read bloom: %w", err)
 	}
-	bloom := DeserializeBloom(bloomData)
+	r.bloom = DeserializeBloom(bloomData)
 
 	// Load index
 	indexData := make([]byte, bloomOffset-indexOffset)
-	if _, err := f.ReadAt(indexData, indexOffset); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("sstable read index: %w", err)
+	if _, err := r.file.ReadAt(indexData, indexOffset); err != nil {
+		return fmt.Errorf("sstable read index: %w", err)
 	}
 
-	index := make([]indexEntry, 0, indexCount)
+	// v1 has no checksums, so bounds checks are all that stand
+	// between a damaged index and a panic.
+	r.index = make([]indexEntry, 0, min(indexCount, uint32(len(indexData)/12)))
 	pos := 0
 	for i := uint32(0); i < indexCount; i++ {
-		keyLen := binary.LittleEndian.Uint32(indexData[pos : pos+4])
+		if len(indexData)-pos < 4 {
+			return r.corruption(indexOffset+int64(pos), "index truncated")
+		}
+		keyLen := int(binary.LittleEndian.Uint32(indexData[pos : pos+4]))
 		pos += 4
-		key := string(indexData[pos : pos+int(keyLen)])
-		pos += int(keyLen)
+		if len(indexData)-pos < keyLen+8 {
+			return r.corruption(indexOffset+int64(pos), "index truncated")
+		}
+		key := string(indexData[pos : pos+keyLen])
+		pos += keyLen
 		offset := int64(binary.LittleEndian.Uint64(indexData[pos : pos+8]))
 		pos += 8
-		index = append(index, indexEntry{Key: key, Offset: offset})
+		if offset < 0 || offset >= r.dataEnd {
+			return r.corruption(indexOffset+int64(pos-8), "index entry out of range")
+		}
+		r.index = append(r.index, indexEntry{Key: key, Offset: offset})
 	}
-
-	return &SSTableReader{file: f, index: index, bloom: bloom}, nil
+	if len(r.index) > 0 {
+		r.smallest = r.index[0].Key
+		r.largest = r.index[len(r.index)-1].Key
+	}
+	return nil
 }
 
-// Get looks up a key in the SSTable.
-// Returns (value, tombstone, found).
+// Get looks up the newest version of a key in the SSTable.
+// Returns (value, tombstone, found); a key deleted by one of the
+// table's range tombstones, or whose value has expired, is reported
+// as a tombstone, and a merge operand as a value. A damaged table
+// reads as a miss; use Lookup to tell the two apart.
 func (r *SSTableReader) Get(key string) ([]byte, bool, bool) {
+	val, tombstone, found, _ := r.Lookup(key)
+	return val, tombstone, found
+}
+
+// Lookup is Get with damage reported: it verifies the checksum of
+// the block it reads and returns (value, tombstone, found, err),
+// where err wraps ErrCorruption if the table is damaged.
+func (r *SSTableReader) Lookup(key string) ([]byte, bool, bool, error) {
+	value, kind, found, err := r.get(key, maxSeqNum, time.Now().UnixNano(), true)
+	return value, kind == KindTombstone, found, err
+}
+
+// get looks up the newest version of key with a sequence number
+// <= seq as of time now, with checksum verification of data blocks
+// optional.
+func (r *SSTableReader) get(key string, seq uint64, now int64, verify bool) ([]byte, EntryKind, bool, error) {
+	// A range tombstone deletes the key unless a newer version of it
+	// is found below.
+	covered := coveringSeq(r.rangeDels, key, seq)
+	missing := func() ([]byte, EntryKind, bool, error) {
+		return nil, KindTombstone, covered > 0, nil
+	}
+
 	// Fast path: check bloom filter first
 	if !r.bloom.MayContain([]byte(key)) {
-		return nil, false, false
+		return missing()
+	}
+	if r.version == 1 {
+		value, tombstone, found, err := r.getV1(key)
+		if tombstone {
+			return value, KindTombstone, found, err
+		}
+		return value, KindValue, found, err
+	}
+
+	// Binary search the block index, then the block's restart points
+	i := r.findBlock(key, seq)
+	if i >= len(r.blocks) {
+		return missing()
+	}
+	bi, err := r.openBlock(i, verify)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	bi.seek(key, seq)
+	if bi.err != nil {
+		return nil, 0, false, r.blockError(i, bi.err)
+	}
+	if !bi.valid || string(bi.key) != key || bi.seq < covered {
+		return missing() // bloom filter false positive, only newer versions, or deleted
+	}
+	switch {
+	case expired(bi.expiresAt, now):
+		return nil, KindTombstone, true, nil
+	case bi.kind == kindTombstone:
+		return bi.value, KindTombstone, true, nil
+	case bi.kind == kindMerge:
+		return bi.value, KindMerge, true, nil
+	}
+	return bi.value, KindValue, true, nil
+}
+
+// newestSeq returns the sequence number of the newest write to key
+// in the table, counting range tombstones that cover it, and whether
+// there is one.
+func (r *SSTableReader) newestSeq(key string) (uint64, bool, error) {
+	seq := coveringSeq(r.rangeDels, key, maxSeqNum)
+	found := seq > 0
+	if !r.bloom.MayContain([]byte(key)) {
+		return seq, found, nil
+	}
+	if r.version == 1 {
+		_, _, ok, err := r.getV1(key)
+		return seq, found || ok, err
+	}
+	i := r.findBlock(key, maxSeqNum)
+	if i >= len(r.blocks) {
+		return seq, found, nil
+	}
+	bi, err := r.openBlock(i, false)
+	if err != nil {
+		return 0, false, err
+	}
+	bi.seek(key, maxSeqNum)
+	if bi.err != nil {
+		return 0, false, r.blockError(i, bi.err)
+	}
+	if bi.valid && string(bi.key) == key {
+		return max(seq, bi.seq), true, nil
+	}
+	return seq, found, nil
+}
+
+// findBlock returns the index of the first data block whose last
+// entry is at or after version seq of key in internal order, which
+// is the only block that can hold the newest version <= seq.
+func (r *SSTableReader) findBlock(key string, seq uint64) int {
+	return sort.Search(len(r.blocks), func(i int) bool {
+		return compareInternal(r.blocks[i].lastKey, r.blocks[i].lastSeq, key, seq) >= 0
+	})
+}
+
+// openBlock returns an unpositioned iterator over data block i,
+// reading it from the block cache or from disk. verify checks the
+// block's checksum if it comes from disk.
+func (r *SSTableReader) openBlock(i int, verify bool) (*blockIter, error) {
+	h := r.blocks[i].handle
+	if r.cache == nil {
+		block, err := r.readBlock(h, verify)
+		if err != nil {
+			return nil, err
+		}
+		return r.newBlockIter(i, block)
+	}
+
+	key := r.cacheKey
+	key.offset = h.offset
+	block, ok := r.cache.get(key)
+	if !ok {
+		var err error
+		if block, err = r.readBlock(h, verify); err != nil {
+			return nil, err
+		}
+		// Don't cache a block that doesn't decode.
+		bi, err := r.newBlockIter(i, block)
+		if err != nil {
+			return nil, err
+		}
+		r.cache.insert(key, block)
+		return bi, nil
 	}
+	return r.newBlockIter(i, block)
+}
+
+func (r *SSTableReader) newBlockIter(i int, block []byte) (*blockIter, error) {
+	bi, err := newBlockIter(block, r.version >= 5)
+	if err != nil {
+		return nil, r.blockError(i, err)
+	}
+	return bi, nil
+}
+
+// readBlock reads a block from disk, checks its checksum if verify
+// is set, and decompresses it.
+func (r *SSTableReader) readBlock(h blockHandle, verify bool) ([]byte, error) {
+	buf := make([]byte, h.size)
+	if _, err := r.file.ReadAt(buf, h.offset); err != nil {
+		return nil, fmt.Errorf("sstable %s: read block at offset %d: %w", r.path, h.offset, err)
+	}
+	if r.version < 3 {
+		return buf, nil
+	}
+	if r.version >= 4 {
+		var err error
+		if buf, err = r.checkSum(buf, h.offset, verify); err != nil {
+			return nil, err
+		}
+	}
+	block, err := decompressBlock(buf)
+	if err != nil {
+		return nil, fmt.Errorf("sstable %s: block at offset %d: %w", r.path, h.offset, err)
+	}
+	return block, nil
+}
 
-	// Binary search the in-memory index
+// checkSum strips the CRC32 trailer from a section of a table read
+// from offset, comparing it against the contents if verify is set.
+func (r *SSTableReader) checkSum(buf []byte, offset int64, verify bool) ([]byte, error) {
+	if len(buf) < blockTrailerSize {
+		return nil, r.corruption(offset, "section too small for its checksum")
+	}
+	body := buf[:len(buf)-blockTrailerSize]
+	if verify && crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return nil, r.corruption(offset, "checksum mismatch")
+	}
+	return body, nil
+}
+
+// corruption returns an ErrCorruption describing damage at offset.
+func (r *SSTableReader) corruption(offset int64, what string) error {
+	return fmt.Errorf("sstable %s: %w: %s at offset %d", r.path, ErrCorruption, what, offset)
+}
+
+// blockError adds the table and block location to a decode error.
+func (r *SSTableReader) blockError(i int, err error) error {
+	return fmt.Errorf("sstable %s: block at offset %d: %w", r.path, r.blocks[i].handle.offset, err)
+}
+
+// getV1 looks up a key through a v1 table's per-key index.
+func (r *SSTableReader) getV1(key string) ([]byte, bool, bool, error) {
 	idx := sort.Search(len(r.index), func(i int) bool {
 		return r.index[i].Key >= key
 	})
 	if idx >= len(r.index) || r.index[idx].Key != key {
-		return nil, false, false // bloom filter false positive
+		return nil, false, false, nil // bloom filter false positive
 	}
-
-	return r.readEntry(r.index[idx].Offset)
+	value, tombstone, err := r.readEntry(r.index[idx].Offset)
+	if err != nil {
+		return nil, false, false, err
+	}
+	return value, tombstone, true, nil
 }
 
-// readEntry reads a single data entry from disk at the given offset.
-func (r *SSTableReader) readEntry(offset int64) ([]byte, bool, bool) {
+// readEntry reads a single v1 data entry from disk at the given
+// offset. v1 tables have no checksums, so lengths that run past the
+// data section are the only damage it can detect.
+func (r *SSTableReader) readEntry(offset int64) ([]byte, bool, error) {
 	buf4 := make([]byte, 4)
 	if _, err := r.file.ReadAt(buf4, offset); err != nil {
-		return nil, false, false
+		return nil, false, fmt.Errorf("sstable %s: read entry at offset %d: %w", r.path, offset, err)
 	}
 	keyLen := binary.LittleEndian.Uint32(buf4)
 
 	// Skip past key, read value length
 	valLenOff := offset + 4 + int64(keyLen)
+	if valLenOff+4 > r.dataEnd {
+		return nil, false, r.corruption(offset, "entry out of range")
+	}
 	if _, err := r.file.ReadAt(buf4, valLenOff); err != nil {
-		return nil, false, false
+		return nil, false, fmt.Errorf("sstable %s: read entry at offset %d: %w", r.path, offset, err)
 	}
 	valLen := binary.LittleEndian.Uint32(buf4)
 
 	// Read value + tombstone byte
 	valOff := valLenOff + 4
+	if valOff+int64(valLen)+1 > r.dataEnd {
+		return nil, false, r.corruption(offset, "entry out of range")
+	}
 	data := make([]byte, valLen+1)
 	if _, err := r.file.ReadAt(data, valOff); err != nil {
-		return nil, false, false
+		return nil, false, fmt.Errorf("sstable %s: read entry at offset %d: %w", r.path, offset, err)
 	}
 
 	value := data[:valLen]
 	tombstone := data[valLen] == 1
-	return value, tombstone, true
+	return value, tombstone, nil
 }
 
-// ReadAll reads all entries from the SSTable in sorted order.
-// Used during compaction to merge SSTables.
-func (r *SSTableReader) ReadAll() []SSTableEntry {
-	entries := make([]SSTableEntry, 0, len(r.index))
-	for _, idx := range r.index {
-		val, tomb, ok := r.readEntry(idx.Offset)
-		if !ok {
-			continue
-		}
-		valueCopy := make([]byte, len(val))
-		copy(valueCopy, val)
+// ReadAll reads all entries from the SSTable in internal order,
+// verifying every block's checksum. Used during compaction to merge
+// SSTables, so that damage is reported rather than copied forward.
+func (r *SSTableReader) ReadAll() ([]SSTableEntry, error) {
+	var entries []SSTableEntry
+	it := newSSTableIterator(r, true)
+	for it.seek(""); it.valid(); it.next() {
+		e := it.entry()
+		valueCopy := make([]byte, len(e.Value))
+		copy(valueCopy, e.Value)
 		entries = append(entries, SSTableEntry{
-			Key:       idx.Key,
+			Key:       e.Key,
+			Seq:       e.Seq,
 			Value:     valueCopy,
-			Tombstone: tomb,
+			ExpiresAt: e.ExpiresAt,
+			Tombstone: e.Tombstone,
+			Merge:     e.Merge,
 		})
 	}
-	return entries
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-// Close closes the underlying SSTable file.
+// ref takes an additional reference on the reader.
+func (r *SSTableReader) ref() {
+	r.refs.Add(1)
+}
+
+// Close releases a reference. The underlying file is closed once
+// the last reference is released.
 func (r *SSTableReader) Close() error {
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
 	return r.file.Close()
 }
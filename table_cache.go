@@ -0,0 +1,144 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Table cache
+//
+// Installed SSTables are described by their tableMeta, which holds
+// everything needed to route a lookup without opening the file. The
+// table cache opens readers on demand and keeps at most
+// Options.MaxOpenTables of them open, closing the least recently
+// used one to make room.
+//
+// A reader handed out by the cache carries its own reference (see
+// SSTableReader), which the caller releases with Close. Eviction
+// only drops the cache's reference, so a reader in use by a Get,
+// an iterator, or a compaction stays open until that user is done.
+// Iterators open a table only once they reach its key range and
+// release it once past it, so each holds at most the tables that
+// overlap its position.
+
+// DefaultMaxOpenTables is the default limit on cached SSTable
+// readers.
+const DefaultMaxOpenTables = 500
+
+// tableCache is an LRU cache of open SSTable readers, keyed by table
+// sequence number. It is safe for concurrent use.
+type tableCache struct {
+	open     func(path string, seq int) (*SSTableReader, error)
+	capacity int
+
+	mu     sync.Mutex
+	lru    list.List // of *tableCacheEntry; front is most recently used
+	items  map[int]*list.Element
+	closed bool
+}
+
+type tableCacheEntry struct {
+	seq    int
+	reader *SSTableReader
+}
+
+func newTableCache(capacity int, open func(path string, seq int) (*SSTableReader, error)) *tableCache {
+	return &tableCache{
+		open:     open,
+		capacity: capacity,
+		items:    make(map[int]*list.Element),
+	}
+}
+
+// get returns a reader for t with a reference the caller must
+// release with Close, opening the file if it isn't cached.
+func (c *tableCache) get(t *tableMeta) (*SSTableReader, error) {
+	if r := c.lookup(t.seq); r != nil {
+		return r, nil
+	}
+	r, err := c.open(t.path, t.seq)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(t.seq, r), nil
+}
+
+// lookup returns a referenced cached reader, or nil.
+func (c *tableCache) lookup(seq int) *SSTableReader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[seq]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	r := e.Value.(*tableCacheEntry).reader
+	r.ref()
+	return r
+}
+
+// add caches a freshly opened reader, taking over the reference it
+// was opened with, and returns a reader with a new reference for the
+// caller. If another caller cached the table first, r is closed and
+// their reader is returned instead. Once the cache is closed, r is
+// handed back uncached.
+func (c *tableCache) add(seq int, r *SSTableReader) *SSTableReader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return r
+	}
+	if e, ok := c.items[seq]; ok {
+		r.Close()
+		c.lru.MoveToFront(e)
+		cached := e.Value.(*tableCacheEntry).reader
+		cached.ref()
+		return cached
+	}
+	for c.lru.Len() > 0 && c.lru.Len() >= c.capacity {
+		c.removeLocked(c.lru.Back())
+	}
+	c.items[seq] = c.lru.PushFront(&tableCacheEntry{seq: seq, reader: r})
+	r.ref()
+	return r
+}
+
+// insert caches a reader the caller has no further use for, such as
+// one just opened to describe a newly written table.
+func (c *tableCache) insert(seq int, r *SSTableReader) {
+	c.add(seq, r).Close()
+}
+
+// evict drops the cached reader for a table that is no longer live.
+func (c *tableCache) evict(seq int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[seq]; ok {
+		c.removeLocked(e)
+	}
+}
+
+func (c *tableCache) removeLocked(e *list.Element) {
+	entry := e.Value.(*tableCacheEntry)
+	c.lru.Remove(e)
+	delete(c.items, entry.seq)
+	entry.reader.Close()
+}
+
+// len returns the number of cached readers.
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// close drops every cached reader. Readers opened later, by
+// iterators that outlive the database, are not cached.
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
@@ -0,0 +1,82 @@
+package lsm
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Expiring entries
+//
+// PutWithTTL writes a value that disappears once its time to live
+// has passed. The write stores an absolute expiry time, in Unix
+// nanoseconds from Options.Clock, next to the value in the WAL, the
+// memtable, and SSTable blocks; an expiry of 0 means the value never
+// expires.
+//
+// Expiry is decided by the clock, not by sequence numbers, so once a
+// version has expired it is gone for every reader, snapshots
+// included. An expired version still hides older versions of its
+// key, exactly like a tombstone: reads treat it as a delete, and
+// compaction turns it into a tombstone, which is then dropped under
+// the usual rules.
+
+// expired reports whether a version with the given expiry is gone at
+// time now. Both are Unix nanoseconds.
+func expired(expiresAt, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
+}
+
+// expireEntries turns the versions in entries that have expired at
+// now into tombstones.
+func expireEntries(entries []SSTableEntry, now int64) {
+	for i, e := range entries {
+		if expired(e.ExpiresAt, now) {
+			entries[i] = SSTableEntry{Key: e.Key, Seq: e.Seq, Tombstone: true}
+		}
+	}
+}
+
+// PutWithTTL writes a key-value pair that expires ttl from now, as
+// told by Options.Clock. Once expired, the key reads as deleted.
+func (db *DB) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	return db.PutWithTTLWithOptions(key, value, ttl, nil)
+}
+
+// PutWithTTLWithOptions is PutWithTTL with a per-write sync override.
+func (db *DB) PutWithTTLWithOptions(key string, value []byte, ttl time.Duration, wo *WriteOptions) error {
+	if ttl <= 0 {
+		return fmt.Errorf("db put: ttl must be positive, got %v", ttl)
+	}
+	expiresAt := db.opts.Clock().Add(ttl).UnixNano()
+	return db.write([]WALEntry{{Op: OpPut, Key: []byte(key), Value: value, ExpiresAt: expiresAt}}, false, wo)
+}
+
+// stampExpiry returns entries with the puts added by
+// WriteBatch.PutWithTTL set to expire their ttl from now. The
+// entries are copied if any needs stamping, so a batch written again
+// gets a fresh expiry.
+func (db *DB) stampExpiry(entries []WALEntry) []WALEntry {
+	var stamped []WALEntry
+	var now time.Time
+	for i, e := range entries {
+		if e.ttl == 0 {
+			continue
+		}
+		if stamped == nil {
+			stamped = slices.Clone(entries)
+			now = db.opts.Clock()
+		}
+		stamped[i].ExpiresAt = now.Add(e.ttl).UnixNano()
+	}
+	if stamped == nil {
+		return entries
+	}
+	return stamped
+}
+
+// now returns the current time from the database's clock in Unix
+// nanoseconds.
+func (db *DB) now() int64 {
+	return db.opts.Clock().UnixNano()
+}
@@ -0,0 +1,186 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Optimistic transactions
+//
+// A Txn reads through a snapshot taken when it begins and buffers
+// its writes, which its own reads see. Nothing is locked while it
+// runs. Commit logs the buffered writes as a single batch record, so
+// they are applied atomically, but only if no key the transaction
+// read from the database has been written since it began; otherwise
+// it fails with ErrConflict and writes nothing.
+//
+// The conflict check compares each read key's newest sequence number
+// with the snapshot's. It runs in the commit queue after every write
+// queued before the commit is visible, and the commit is logged
+// before any write queued after it, so no write can slip in between
+// the check and the commit (see commit.go). The snapshot keeps every
+// newer version from being compacted away, so a write is never missed
+// because compaction merged it with older ones.
+
+// ErrConflict is returned by Txn.Commit when a key the transaction
+// read was written after the transaction began.
+var ErrConflict = fmt.Errorf("transaction conflict")
+
+// errTxnDone is returned when a committed or rolled back transaction
+// is used.
+var errTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn is an optimistic transaction started by DB.BeginTxn. A Txn is
+// not safe for concurrent use. It must end with Commit or Rollback.
+type Txn struct {
+	db     *DB
+	snap   *Snapshot
+	batch  WriteBatch
+	writes map[string]WALEntry // latest buffered write of each key
+	reads  map[string]struct{} // keys read from the database
+}
+
+// BeginTxn starts a transaction that sees the database as of now.
+func (db *DB) BeginTxn() *Txn {
+	return &Txn{
+		db:     db,
+		snap:   db.GetSnapshot(),
+		writes: make(map[string]WALEntry),
+		reads:  make(map[string]struct{}),
+	}
+}
+
+// Get reads key as of when the transaction began, or as left by the
+// transaction's own writes. Keys read from the database are checked
+// for conflicts at commit. The caller must not modify the returned
+// slice.
+func (t *Txn) Get(key string) ([]byte, error) {
+	if t.snap == nil {
+		return nil, errTxnDone
+	}
+	if e, ok := t.writes[key]; ok {
+		if e.Op == OpDelete {
+			return nil, ErrKeyNotFound
+		}
+		return e.Value, nil
+	}
+	t.reads[key] = struct{}{}
+	return t.db.GetWithOptions(key, &ReadOptions{Snapshot: t.snap})
+}
+
+// Put buffers a write of key. The value is copied.
+func (t *Txn) Put(key string, value []byte) {
+	if t.snap == nil {
+		return
+	}
+	t.batch.Put(key, value)
+	t.writes[key] = t.batch.entries[len(t.batch.entries)-1]
+}
+
+// Delete buffers a delete of key.
+func (t *Txn) Delete(key string) {
+	if t.snap == nil {
+		return
+	}
+	t.batch.Delete(key)
+	t.writes[key] = t.batch.entries[len(t.batch.entries)-1]
+}
+
+// Commit applies the transaction's writes atomically, or returns
+// ErrConflict if a key it read has been written since it began. The
+// transaction is over either way.
+func (t *Txn) Commit() error {
+	return t.CommitWithOptions(nil)
+}
+
+// CommitWithOptions is Commit with a per-write sync override.
+func (t *Txn) CommitWithOptions(wo *WriteOptions) error {
+	if t.snap == nil {
+		return errTxnDone
+	}
+	defer t.Rollback()
+	if t.batch.Count() == 0 {
+		return nil
+	}
+	w, err := t.db.newWriter(t.batch.entries, true, wo)
+	if err != nil {
+		return err
+	}
+	w.check = t.checkConflicts
+	return t.db.commit(w)
+}
+
+// Rollback discards the transaction's writes. Rolling back a
+// finished transaction is a no-op.
+func (t *Txn) Rollback() {
+	if t.snap == nil {
+		return
+	}
+	t.snap.Release()
+	t.snap = nil
+}
+
+// checkConflicts returns ErrConflict if a key the transaction read
+// was written after its snapshot.
+func (t *Txn) checkConflicts() error {
+	for key := range t.reads {
+		changed, err := t.db.changedSince(key, t.snap.seq)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// changedSince reports whether key was written, or deleted by a
+// range tombstone, after sequence number seq. Sources are checked
+// newest first, and the first that has written key holds its newest
+// write.
+func (db *DB) changedSince(key string, seq uint64) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+
+	mems := []*Memtable{db.mem}
+	for _, imm := range db.imm {
+		mems = append(mems, imm.mem)
+	}
+	for _, m := range mems {
+		if newest, found := m.newestSeq(key); found {
+			return newest > seq, nil
+		}
+	}
+	for level, tables := range db.levels {
+		candidates := tables
+		if db.opts.CompactionStrategy.disjoint(level) {
+			t := findTable(tables, key)
+			if t == nil {
+				continue
+			}
+			candidates = []*tableMeta{t}
+		}
+		for _, t := range candidates {
+			if !t.contains(key) {
+				continue
+			}
+			r, err := db.tables.get(t)
+			if err != nil {
+				return false, fmt.Errorf("db txn: %w", err)
+			}
+			newest, found, err := r.newestSeq(key)
+			r.Close()
+			if err != nil {
+				return false, fmt.Errorf("db txn: %w", err)
+			}
+			if found {
+				return newest > seq, nil
+			}
+		}
+	}
+	return false, nil
+}
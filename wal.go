@@ -2,10 +2,12 @@ package lsm
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"time"
 )
 
 // OpType represents the type of WAL operation.
@@ -14,29 +16,76 @@ type OpType byte
 const (
 	OpPut    OpType = 1
 	OpDelete OpType = 2
+	// OpBatch marks a record holding several operations that must be
+	// applied together. Replay expands it into its individual entries.
+	OpBatch OpType = 3
+
+	// opSequence prefixes a record with the sequence number of its
+	// first operation. Records without it predate sequence numbers.
+	opSequence OpType = 4
+
+	// OpDeleteRange deletes the keys in [Key, Value).
+	OpDeleteRange OpType = 5
+
+	// opPutExpiring is how an OpPut with an expiry is logged. It
+	// reads back as OpPut.
+	opPutExpiring OpType = 6
+
+	// OpMerge records a merge operand for Key (see merge.go).
+	OpMerge OpType = 7
 )
 
 // WALEntry is a single operation recorded in the write-ahead log.
 type WALEntry struct {
 	Op    OpType
 	Key   []byte
-	Value []byte // empty for deletes
+	Value []byte // empty for deletes; the end key for range deletes; the operand for merges
+	Seq   uint64 // sequence number; 0 if not yet assigned
+
+	// ExpiresAt is when a put expires, in Unix nanoseconds; 0 if it
+	// never does (see ttl.go).
+	ExpiresAt int64
+
+	// ttl is the time to live of a put added to a batch with
+	// PutWithTTL, turned into ExpiresAt when the batch is written.
+	ttl time.Duration
 }
 
 // WAL is an append-only write-ahead log that survives crashes.
-// Every write is fsync'd before returning, so committed entries
-// are guaranteed to be on disk.
+// With the default SyncAlways mode every write is fsync'd before
+// returning, so committed entries are guaranteed to be on disk.
 type WAL struct {
-	file *os.File
+	file     *os.File
+	opts     walOptions
+	unsynced bool // bytes written since the last fsync
 }
 
-// OpenWAL opens (or creates) a write-ahead log at the given path.
+// walOptions holds the WAL settings derived from Options. Only
+// SyncAlways makes Append fsync; under the other modes the owner is
+// responsible for calling Sync.
+type walOptions struct {
+	maxRecordSize int
+	syncMode      SyncMode
+	perm          os.FileMode
+}
+
+// defaultWALOptions returns the WAL settings used by OpenWAL.
+func defaultWALOptions() walOptions {
+	return DefaultOptions().walOptions()
+}
+
+// OpenWAL opens (or creates) a write-ahead log at the given path
+// using the default options.
 func OpenWAL(path string) (*WAL, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	return openWAL(path, defaultWALOptions())
+}
+
+func openWAL(path string, opts walOptions) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, opts.perm)
 	if err != nil {
 		return nil, fmt.Errorf("wal open: %w", err)
 	}
-	return &WAL{file: f}, nil
+	return &WAL{file: f, opts: opts}, nil
 }
 
 // Append writes an entry to the log and fsyncs it to disk.
@@ -46,115 +95,340 @@ func OpenWAL(path string) (*WAL, error) {
 //	[4 bytes total length][4 bytes CRC32][1 byte op][4 bytes key len][key][4 bytes value len][value]
 //
 // The CRC32 covers everything after the CRC field (op + key len + key + value len + value).
+// A put with an expiry is logged with op opPutExpiring and the expiry
+// after the op:
+//
+//	[1 byte opPutExpiring][8 bytes expires_at][4 bytes key len][key][4 bytes value len][value]
+//
+// An entry with a sequence number is prefixed by it:
+//
+//	[1 byte opSequence][8 bytes seq][entry or batch payload]
 func (w *WAL) Append(entry WALEntry) error {
-	// Build the payload: op + key_len + key + val_len + val
-	payloadSize := 1 + 4 + len(entry.Key) + 4 + len(entry.Value)
-	payload := make([]byte, payloadSize)
-
-	off := 0
-	payload[off] = byte(entry.Op)
-	off++
-	binary.LittleEndian.PutUint32(payload[off:], uint32(len(entry.Key)))
-	off += 4
-	copy(payload[off:], entry.Key)
-	off += len(entry.Key)
-	binary.LittleEndian.PutUint32(payload[off:], uint32(len(entry.Value)))
-	off += 4
-	copy(payload[off:], entry.Value)
+	return w.writeRecord(encodeSequence(entry.Seq, encodeEntry(nil, entry)))
+}
+
+// AppendBatch writes several entries as a single record, so a crash
+// either preserves all of them or none. Their sequence numbers, if
+// assigned, must be consecutive.
+//
+// Batch payload format (inside the usual length + CRC32 framing):
+//
+//	[1 byte OpBatch][4 bytes count][op][4 bytes key len][key][4 bytes value len][value]...
+func (w *WAL) AppendBatch(entries []WALEntry) error {
+	var seq uint64
+	if len(entries) > 0 {
+		seq = entries[0].Seq
+	}
+	return w.writeRecord(encodeSequence(seq, encodeBatch(entries)))
+}
+
+// sequenceHeaderSize is the size of the opSequence prefix.
+const sequenceHeaderSize = 1 + 8
+
+// encodeSequence prefixes a payload with the sequence number of its
+// first operation. A zero seq leaves the payload unsequenced.
+func encodeSequence(seq uint64, payload []byte) []byte {
+	if seq == 0 {
+		return payload
+	}
+	buf := make([]byte, 0, sequenceHeaderSize+len(payload))
+	buf = append(buf, byte(opSequence))
+	buf = binary.LittleEndian.AppendUint64(buf, seq)
+	return append(buf, payload...)
+}
+
+// encodeBatch builds the payload of an OpBatch record.
+func encodeBatch(entries []WALEntry) []byte {
+	payload := make([]byte, 5)
+	payload[0] = byte(OpBatch)
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(len(entries)))
+	for _, e := range entries {
+		payload = encodeEntry(payload, e)
+	}
+	return payload
+}
+
+// encodeEntry appends op + key_len + key + val_len + val to buf,
+// with the expiry after the op for an expiring put.
+func encodeEntry(buf []byte, entry WALEntry) []byte {
+	var lenBuf [4]byte
+	if entry.Op == OpPut && entry.ExpiresAt != 0 {
+		buf = append(buf, byte(opPutExpiring))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	} else {
+		buf = append(buf, byte(entry.Op))
+	}
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(entry.Key)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, entry.Key...)
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(entry.Value)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, entry.Value...)
+	return buf
+}
+
+// writeRecord frames a single payload and writes it to the log.
+func (w *WAL) writeRecord(payload []byte) error {
+	record, err := frameRecord(payload, w.opts.maxRecordSize)
+	if err != nil {
+		return err
+	}
+	return w.write(record, w.opts.syncMode == SyncAlways)
+}
+
+// frameRecord prefixes a payload with its length and CRC32. It
+// rejects payloads larger than maxRecordSize, which Replay would
+// otherwise treat as corruption.
+func frameRecord(payload []byte, maxRecordSize int) ([]byte, error) {
+	if err := checkRecordSize(len(payload), maxRecordSize); err != nil {
+		return nil, err
+	}
 
 	// Compute CRC over the payload
 	checksum := crc32.ChecksumIEEE(payload)
 
 	// Build the full record: length + CRC + payload
-	record := make([]byte, 4+4+payloadSize)
-	binary.LittleEndian.PutUint32(record[0:4], uint32(payloadSize))
+	record := make([]byte, 4+4+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
 	binary.LittleEndian.PutUint32(record[4:8], checksum)
 	copy(record[8:], payload)
+	return record, nil
+}
 
-	n, err := w.file.Write(record)
+// checkRecordSize rejects a payload of size bytes if it is over the
+// limit.
+func checkRecordSize(size, maxRecordSize int) error {
+	if size > maxRecordSize {
+		return fmt.Errorf("wal record too large: %d bytes (max %d)", size, maxRecordSize)
+	}
+	return nil
+}
+
+// write appends one or more already framed records in a single
+// write call, then fsyncs the file if sync is set. Group commit uses
+// this to make many records durable with one fsync.
+func (w *WAL) write(records []byte, sync bool) error {
+	n, err := w.file.Write(records)
 	if err != nil {
 		return fmt.Errorf("wal write: %w", err)
 	}
-	if n != len(record) {
-		return fmt.Errorf("wal short write: wrote %d of %d bytes", n, len(record))
+	if n != len(records) {
+		return fmt.Errorf("wal short write: wrote %d of %d bytes", n, len(records))
+	}
+	w.unsynced = true
+	if !sync {
+		return nil
+	}
+	return w.Sync()
+}
+
+// Sync fsyncs any records written since the last sync.
+func (w *WAL) Sync() error {
+	if !w.unsynced {
+		return nil
 	}
 	// fsync ensures durability. On macOS this uses F_FULLFSYNC
 	if err := w.file.Sync(); err != nil {
 		return fmt.Errorf("wal sync: %w", err)
 	}
+	w.unsynced = false
 	return nil
 }
 
 // Replay reads all valid entries from the WAL file. Partial or
 // corrupted entries at the tail are silently skipped — they
-// represent writes that weren't fsync'd before a crash.
+// represent writes that weren't fsync'd before a crash. Entries
+// logged without a sequence number have Seq 0.
 func Replay(path string) ([]WALEntry, error) {
+	return replayWAL(path, DefaultMaxWALRecordSize)
+}
+
+// replayWAL is Replay with a configurable record size limit.
+func replayWAL(path string, maxRecordSize int) ([]WALEntry, error) {
+	var entries []WALEntry
+	err := readRecords(path, maxRecordSize, func(payload []byte) bool {
+		decoded, err := decodePayload(payload)
+		if err != nil {
+			return false
+		}
+		entries = append(entries, decoded...)
+		return true
+	})
+	// Replay stops at the first bad record wherever it is: unsynced
+	// pages can reach the disk out of order, so a crash may leave a
+	// hole before data that made it.
+	if err != nil && !errors.Is(err, errTornRecord) && !errors.Is(err, ErrCorruption) {
+		return nil, fmt.Errorf("wal replay open: %w", err)
+	}
+	return entries, nil
+}
+
+// errTornRecord reports a partial or damaged record at the end of a
+// file, as a crash in the middle of an append leaves behind.
+var errTornRecord = fmt.Errorf("torn record at end of file")
+
+// readRecords passes the payload of each framed record in the file
+// to fn, in order, until fn returns false. It returns errTornRecord
+// if the file ends in a partial or damaged record, and an error
+// wrapping ErrCorruption if a damaged record is followed by more
+// data. A missing file has no records.
+func readRecords(path string, maxRecordSize int, fn func(payload []byte) bool) error {
 	f, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil
 		}
-		return nil, fmt.Errorf("wal replay open: %w", err)
+		return err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
-	var entries []WALEntry
 	header := make([]byte, 8) // length + CRC
+	var offset int64
+
+	// damaged reports a bad record ending at end: a torn tail if
+	// nothing follows it, corruption otherwise.
+	damaged := func(end int64) error {
+		if end >= info.Size() {
+			return errTornRecord
+		}
+		return fmt.Errorf("%w: bad record at offset %d of %s", ErrCorruption, offset, path)
+	}
 
 	for {
 		// Read the 8-byte header
 		if _, err := io.ReadFull(f, header); err != nil {
-			break // EOF or partial header — done
+			if err == io.EOF {
+				return nil
+			}
+			return errTornRecord // partial header
 		}
 		length := binary.LittleEndian.Uint32(header[0:4])
 		storedCRC := binary.LittleEndian.Uint32(header[4:8])
+		end := offset + int64(len(header)) + int64(length)
 
 		// Sanity check: reject absurdly large entries
-		if length > 64*1024*1024 {
-			break
+		if uint64(length) > uint64(maxRecordSize) {
+			return damaged(end)
 		}
 
 		payload := make([]byte, length)
 		if _, err := io.ReadFull(f, payload); err != nil {
-			break // partial payload — entry wasn't fully written
+			return errTornRecord // partial payload — entry wasn't fully written
 		}
 
 		// Verify checksum
 		if crc32.ChecksumIEEE(payload) != storedCRC {
-			break // corrupted entry — stop here
+			return damaged(end)
 		}
 
-		entry, err := decodePayload(payload)
+		if !fn(payload) {
+			return nil
+		}
+		offset = end
+	}
+}
+
+// decodePayload parses a WAL payload into the entries it holds.
+// A batch record expands to all of its operations; any other record
+// holds exactly one. A sequenced record numbers its entries
+// consecutively from its sequence number.
+func decodePayload(payload []byte) ([]WALEntry, error) {
+	if len(payload) > 0 && OpType(payload[0]) == opSequence {
+		if len(payload) < sequenceHeaderSize {
+			return nil, fmt.Errorf("sequence header too short")
+		}
+		seq := binary.LittleEndian.Uint64(payload[1:sequenceHeaderSize])
+		inner := payload[sequenceHeaderSize:]
+		if len(inner) > 0 && OpType(inner[0]) == opSequence {
+			return nil, fmt.Errorf("nested sequence header")
+		}
+		entries, err := decodePayload(inner)
 		if err != nil {
-			break
+			return nil, err
+		}
+		for i := range entries {
+			entries[i].Seq = seq + uint64(i)
+		}
+		return entries, nil
+	}
+	if len(payload) > 0 && OpType(payload[0]) == OpBatch {
+		return decodeBatch(payload)
+	}
+	entry, n, err := decodeEntry(payload)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(payload) {
+		return nil, fmt.Errorf("payload has trailing bytes")
+	}
+	return []WALEntry{entry}, nil
+}
+
+// decodeBatch parses the operations inside an OpBatch payload.
+func decodeBatch(payload []byte) ([]WALEntry, error) {
+	if len(payload) < 5 {
+		return nil, fmt.Errorf("batch payload too short")
+	}
+	count := binary.LittleEndian.Uint32(payload[1:5])
+	entries := make([]WALEntry, 0, count)
+	pos := 5
+	for i := uint32(0); i < count; i++ {
+		entry, n, err := decodeEntry(payload[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("batch entry %d: %w", i, err)
+		}
+		if entry.Op == OpBatch || entry.Op == opSequence {
+			return nil, fmt.Errorf("batch entry %d: nested batch", i)
 		}
 		entries = append(entries, entry)
+		pos += n
+	}
+	if pos != len(payload) {
+		return nil, fmt.Errorf("batch payload has trailing bytes")
 	}
 	return entries, nil
 }
 
-// decodePayload parses the op + key + value from a WAL payload.
-func decodePayload(payload []byte) (WALEntry, error) {
-	if len(payload) < 9 { // 1 op + 4 key_len + at least 0 key + 4 val_len
-		return WALEntry{}, fmt.Errorf("payload too short")
+// decodeEntry parses a single op + key + value from the front of buf
+// and returns the number of bytes consumed.
+func decodeEntry(buf []byte) (WALEntry, int, error) {
+	if len(buf) < 9 { // 1 op + 4 key_len + at least 0 key + 4 val_len
+		return WALEntry{}, 0, fmt.Errorf("payload too short")
+	}
+	op := OpType(buf[0])
+	var expiresAt int64
+	header := 0
+	if op == opPutExpiring {
+		// Drop the expiry, leaving its last byte to stand in for
+		// the op.
+		expiresAt = int64(binary.LittleEndian.Uint64(buf[1:9]))
+		op = OpPut
+		header = 8
+		buf = buf[header:]
+		if len(buf) < 9 {
+			return WALEntry{}, 0, fmt.Errorf("payload too short")
+		}
 	}
-	op := OpType(payload[0])
-	keyLen := binary.LittleEndian.Uint32(payload[1:5])
-	if uint32(len(payload)) < 5+keyLen+4 {
-		return WALEntry{}, fmt.Errorf("payload truncated at key")
+	keyLen := binary.LittleEndian.Uint32(buf[1:5])
+	if uint64(len(buf)) < 5+uint64(keyLen)+4 {
+		return WALEntry{}, 0, fmt.Errorf("payload truncated at key")
 	}
 	key := make([]byte, keyLen)
-	copy(key, payload[5:5+keyLen])
+	copy(key, buf[5:5+keyLen])
 
 	valOff := 5 + keyLen
-	valLen := binary.LittleEndian.Uint32(payload[valOff : valOff+4])
-	if uint32(len(payload)) < valOff+4+valLen {
-		return WALEntry{}, fmt.Errorf("payload truncated at value")
+	valLen := binary.LittleEndian.Uint32(buf[valOff : valOff+4])
+	if uint64(len(buf)) < uint64(valOff)+4+uint64(valLen) {
+		return WALEntry{}, 0, fmt.Errorf("payload truncated at value")
 	}
 	value := make([]byte, valLen)
-	copy(value, payload[valOff+4:valOff+4+valLen])
+	copy(value, buf[valOff+4:valOff+4+valLen])
 
-	return WALEntry{Op: op, Key: key, Value: value}, nil
+	return WALEntry{Op: op, Key: key, Value: value, ExpiresAt: expiresAt}, header + int(valOff+4+valLen), nil
 }
 
 // Close closes the WAL file.